@@ -0,0 +1,81 @@
+package jq
+
+import (
+	"strings"
+	"unicode"
+)
+
+// splitDirectives splits a jq program into its leading module, import and include directives,
+// including comments between them, and the rest of the program.
+// jq only accepts directives at the start of a program, before any definition or expression.
+func splitDirectives(prog string) (string, string) {
+	end := 0
+	pos := 0
+	for {
+		pos = skipSpaceAndComments(prog, pos)
+		if !startsWithKeyword(prog[pos:], "module") && !startsWithKeyword(prog[pos:], "import") &&
+			!startsWithKeyword(prog[pos:], "include") {
+			return prog[:end], prog[end:]
+		}
+		semicolon := findDirectiveEnd(prog, pos)
+		if semicolon < 0 {
+			// Incomplete directive, left to the compiler to report
+			return prog[:end], prog[end:]
+		}
+		end = semicolon + 1
+		pos = end
+	}
+}
+
+func skipSpaceAndComments(prog string, pos int) int {
+	for pos < len(prog) {
+		switch {
+		case prog[pos] == '#':
+			nl := strings.IndexByte(prog[pos:], '\n')
+			if nl < 0 {
+				return len(prog)
+			}
+			pos += nl + 1
+		case unicode.IsSpace(rune(prog[pos])):
+			pos++
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+func startsWithKeyword(s string, keyword string) bool {
+	if !strings.HasPrefix(s, keyword) {
+		return false
+	}
+	if len(s) == len(keyword) {
+		return true
+	}
+	next := rune(s[len(keyword)])
+	return next != '_' && !unicode.IsLetter(next) && !unicode.IsDigit(next)
+}
+
+// findDirectiveEnd returns the index of the semicolon ending the directive at pos, or -1.
+// Semicolons in strings and in the metadata object are skipped.
+func findDirectiveEnd(prog string, pos int) int {
+	depth := 0
+	inString := false
+	for i := pos; i < len(prog); i++ {
+		c := prog[i]
+		switch {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == ';' && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
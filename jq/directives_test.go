@@ -0,0 +1,22 @@
+package jq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitDirectives(t *testing.T) {
+	cases := [][3]string{
+		{".a", "", ".a"},
+		{`include "util"; .a`, `include "util";`, " .a"},
+		{"# comment\nimport \"a;b\" as ab;\ninclude \"c\" {search: \"./;\"};\n.a | ab::f",
+			"# comment\nimport \"a;b\" as ab;\ninclude \"c\" {search: \"./;\"};", "\n.a | ab::f"},
+		{"def included: 1; included", "", "def included: 1; included"},
+		{`include "util"`, "", `include "util"`},
+	}
+	for _, c := range cases {
+		directives, body := splitDirectives(c[0])
+		assert.Equal(t, c[1], directives, c[0])
+		assert.Equal(t, c[2], body, c[0])
+	}
+}
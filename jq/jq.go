@@ -15,6 +15,9 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -25,6 +28,10 @@ type Jq struct {
 	state          *C.struct_jq_state
 	errorHandlerID uint64
 	errorHandler   func(err string)
+	// Variables of a program compiled with CompileProgramWithVars
+	varNames []string
+	// Prepended to every compiled program, see SetLibrary
+	prelude string
 }
 
 // Note: you can only set one error handler per jq instance
@@ -66,10 +73,10 @@ func (eh *ErrorCallbackMap) getErrorHandler(id uint64) (func(err string), bool)
 // It therefore needs to dispatch the error to the correct jq instance
 // error handler, based on the id parameter.
 //export goJqErrorHandler
-func goJqErrorHandler(id uint64, jv C.jv) {
+func goJqErrorHandler(id uint64, errJv C.jv) {
 	handler, ok := globalErrorCallbacks.getErrorHandler(id)
 	if ok {
-		err := Jv{C.jq_format_error(jv)}
+		err := Jv{C.jq_format_error(errJv)}
 		handler(err.ToString())
 	}
 }
@@ -97,9 +104,87 @@ func (jq *Jq) handleError(err string) {
 
 // CompileProgram compiles a jq program for the passed Jq instance
 func (jq *Jq) CompileProgram(prog string) error {
-	csProg := C.CString(prog)
+	jq.varNames = nil
+	return jq.compile(prog, nil, C.jv_array())
+}
+
+// CompileProgramWithVars compiles a jq program which can use the variables $<name> for the passed names.
+// Their values are passed to ProcessInputJvWithVars. Unlike named arguments of jq_compile_args,
+// the values can change on every run.
+func (jq *Jq) CompileProgramWithVars(prog string, names []string) error {
+	if len(names) == 0 {
+		return jq.CompileProgram(prog)
+	}
+	// Compile the program alone with the variables as named arguments first,
+	// so that errors refer to the program and not to the wrapper binding the variables
+	// An object because libjq reads an array of {name, value} with more than one entry after freeing it
+	args := C.jv_object()
+	for _, name := range names {
+		args = C.jv_object_set(args, newJvString(name), C.jv_null())
+	}
+	err := jq.compile(prog, nil, args)
+	if err != nil {
+		return err
+	}
+	err = jq.compile(prog, names, C.jv_array())
+	if err != nil {
+		return err
+	}
+	jq.varNames = names
+	return nil
+}
+
+// SetLibrary makes the modules in paths available to programs compiled afterwards, and prepends the prelude
+// to them, e.g. include directives and function definitions. Compile errors in the prelude are reported
+// at <library>, line numbers in the program are not shifted by the prelude.
+func (jq *Jq) SetLibrary(paths []string, prelude string) {
+	jvPaths := C.jv_array()
+	for _, p := range paths {
+		jvPaths = C.jv_array_append(jvPaths, newJvString(p))
+	}
+	C.jq_set_attr(jq.state, newJvString("JQ_LIBRARY_PATH"), jvPaths)
+	jq.prelude = prelude
+}
+
+func newJvString(s string) C.jv {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	return C.jv_string(cs)
+}
+
+// sourcePart is a part of the compiled source, which starts at line of file
+type sourcePart struct {
+	file string
+	line int
+	text string
+}
+
+// compile compiles prog with the named arguments args, which it consumes.
+// If vars are given, the program is wrapped to bind them from the input [input, vars]. The program
+// goes on lines of its own in the wrapper, so that a trailing comment does not swallow its end.
+// The directives of the prelude and of the program go first, as jq requires. Those of the prelude
+// come before those of the program, because libjq ignores includes after an import.
+func (jq *Jq) compile(prog string, vars []string, args C.jv) error {
+	progDirectives, body := splitDirectives(prog)
+	preludeDirectives, preludeBody := splitDirectives(jq.prelude)
+	bodyLine := 1 + strings.Count(progDirectives, "\n")
+	if len(vars) > 0 {
+		body = ".[1] as {$" + strings.Join(vars, ", $") + "} | .[0] | (\n" + body + "\n)"
+		bodyLine--
+	}
+	parts := []sourcePart{
+		{"<library>", 1, preludeDirectives},
+		{"<top-level>", 1, progDirectives},
+		{"<library>", 1 + strings.Count(preludeDirectives, "\n"), preludeBody},
+		{"<top-level>", bodyLine, body},
+	}
+	source := ""
+	for _, p := range parts {
+		source += p.text + "\n"
+	}
+
+	csProg := C.CString(source)
 	defer C.free(unsafe.Pointer(csProg))
-	args := C.jv_array()
 
 	errs := ""
 	jq.errorHandler = func(err string) {
@@ -109,11 +194,29 @@ func (jq *Jq) CompileProgram(prog string) error {
 	C.jq_compile_args(jq.state, csProg, args)
 
 	if errs != "" {
-		return errors.New(errs)
+		return errors.New(fixErrorLines(errs, parts))
 	}
 	return nil
 }
 
+var errorLocationPattern = regexp.MustCompile(`at <top-level>, line (\d+)`)
+
+// fixErrorLines attributes compile errors to the lines of the prelude or the program
+func fixErrorLines(errs string, parts []sourcePart) string {
+	return errorLocationPattern.ReplaceAllStringFunc(errs, func(loc string) string {
+		line, _ := strconv.Atoi(errorLocationPattern.FindStringSubmatch(loc)[1])
+		start := 1
+		for _, p := range parts {
+			lines := strings.Count(p.text, "\n") + 1
+			if line < start+lines {
+				return fmt.Sprintf("at %s, line %d", p.file, p.line+line-start)
+			}
+			start += lines
+		}
+		return loc
+	})
+}
+
 // ProcessInput runs the previously compiled program of the Jq instance on the input
 func (jq *Jq) ProcessInput(input string) ([]*Jv, error) {
 	jvInput, err := parseInput(input)
@@ -137,6 +240,16 @@ func (jq *Jq) ProcessInputJv(input *Jv) ([]*Jv, error) {
 	return jq.processInput(input.Copy(), false)
 }
 
+// ProcessInputJvWithVars runs a program compiled with CompileProgramWithVars on the input.
+// vars is an object with the values of the variables.
+func (jq *Jq) ProcessInputJvWithVars(input *Jv, vars *Jv) ([]*Jv, error) {
+	if len(jq.varNames) == 0 {
+		return jq.ProcessInputJv(input)
+	}
+	jvInput := C.jv_array_append(C.jv_array_append(C.jv_array(), C.jv_copy(input.jv)), C.jv_copy(vars.jv))
+	return jq.processInput(&Jv{jvInput}, false)
+}
+
 func (jq *Jq) processInput(jvInput *Jv, firstOnly bool) ([]*Jv, error) {
 	results := make([]*Jv, 0)
 	flags := C.int(0)
@@ -146,19 +259,41 @@ func (jq *Jq) processInput(jvInput *Jv, firstOnly bool) ([]*Jv, error) {
 	for C.jv_is_valid(res) != 0 {
 		results = append(results, &Jv{res})
 		if firstOnly {
-			break
+			return results, nil
 		}
 		res = C.jq_next(jq.state)
 	}
 
+	// The end of the results is an invalid value, with a message if the program raised an error
+	if C.jv_invalid_has_msg(C.jv_copy(res)) != 0 {
+		msg := Jv{C.jv_invalid_get_msg(res)}
+		defer msg.Free()
+		for _, r := range results {
+			r.Free()
+		}
+		return nil, errors.New("jq: error: " + msg.ToString())
+	}
+	C.jv_free(res)
+
 	return results, nil
 }
 
+// Parse parses json data without copying it into C memory first. The returned value must be freed.
+func Parse(data []byte) (*Jv, error) {
+	if len(data) == 0 {
+		return parseInput("")
+	}
+	return checkParsed(C.jv_parse_sized((*C.char)(unsafe.Pointer(&data[0])), C.int(len(data))))
+}
+
 func parseInput(input string) (*Jv, error) {
 	csInput := C.CString(input)
 	defer C.free(unsafe.Pointer(csInput))
 
-	jvInput := C.jv_parse(csInput)
+	return checkParsed(C.jv_parse(csInput))
+}
+
+func checkParsed(jvInput C.jv) (*Jv, error) {
 	if C.jv_is_valid(jvInput) == 0 {
 		err := Jv{C.jq_format_error(jvInput)}
 		return nil, errors.New(err.ToString())
@@ -190,6 +325,60 @@ func (jv *Jv) IsString() bool {
 	return C.jv_get_kind(jv.jv) == C.JV_KIND_STRING
 }
 
+func (jv *Jv) IsNull() bool {
+	return C.jv_get_kind(jv.jv) == C.JV_KIND_NULL
+}
+
+func (jv *Jv) IsBoolean() bool {
+	kind := C.jv_get_kind(jv.jv)
+	return kind == C.JV_KIND_TRUE || kind == C.JV_KIND_FALSE
+}
+
+func (jv *Jv) IsObject() bool {
+	return C.jv_get_kind(jv.jv) == C.JV_KIND_OBJECT
+}
+
+func (jv *Jv) IsArray() bool {
+	return C.jv_get_kind(jv.jv) == C.JV_KIND_ARRAY
+}
+
+// Len returns the length of an array
+func (jv *Jv) Len() int {
+	return int(C.jv_array_length(C.jv_copy(jv.jv)))
+}
+
+// Index returns the i-th element of an array. The returned value must be freed.
+func (jv *Jv) Index(i int) *Jv {
+	return &Jv{C.jv_array_get(C.jv_copy(jv.jv), C.int(i))}
+}
+
+// Keys returns the sorted keys of an object
+func (jv *Jv) Keys() []string {
+	jvKeys := C.jv_keys(C.jv_copy(jv.jv))
+	defer C.jv_free(jvKeys)
+	n := int(C.jv_array_length(C.jv_copy(jvKeys)))
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key := C.jv_array_get(C.jv_copy(jvKeys), C.int(i))
+		keys = append(keys, C.GoString(C.jv_string_value(key)))
+		C.jv_free(key)
+	}
+	return keys
+}
+
+// Get returns the value of a key of an object, or nil if there is no such key.
+// The returned value must be freed.
+func (jv *Jv) Get(key string) *Jv {
+	csKey := C.CString(key)
+	defer C.free(unsafe.Pointer(csKey))
+	val := C.jv_object_get(C.jv_copy(jv.jv), C.jv_string(csKey))
+	if C.jv_is_valid(val) == 0 {
+		C.jv_free(val)
+		return nil
+	}
+	return &Jv{val}
+}
+
 func (jv *Jv) ToNumber() interface{} {
 	dbl := C.jv_number_value(jv.jv)
 	if C.jv_is_integer(jv.jv) == 0 {
@@ -199,14 +388,13 @@ func (jv *Jv) ToNumber() interface{} {
 }
 
 func (jv *Jv) toString(flags C.int) string {
-	jvStr := C.jv_dump_string(jv.Copy().jv, flags)
-	defer C.jv_free(jvStr)
-	str := C.GoString(C.jv_string_value(jvStr))
-	// Always use "raw" output: no quotes around strings
+	// Always use "raw" output: strings as they are, without quotes and escapes
 	if C.jv_get_kind(jv.jv) == C.JV_KIND_STRING {
-		str = str[1 : len(str)-1]
+		return C.GoStringN(C.jv_string_value(jv.jv), C.jv_string_length_bytes(C.jv_copy(jv.jv)))
 	}
-	return str
+	jvStr := C.jv_dump_string(jv.Copy().jv, flags)
+	defer C.jv_free(jvStr)
+	return C.GoString(C.jv_string_value(jvStr))
 }
 
 // ToString returns a non-pretty-print string representation of the json value
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 package jq
 
 import (
@@ -72,3 +75,25 @@ func TestProcessInvalidInput(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "jq: error: Invalid numeric literal at line")
 }
+
+func TestCompileProgramWithUndefinedVar(t *testing.T) {
+	jqInst := New()
+	defer jqInst.Close()
+
+	// The wrapper binding the variables must not show up in errors
+	err := jqInst.CompileProgramWithVars(".foo > $max", []string{"min"})
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), ".[1] as")
+}
+
+func TestCompileProgramWithVarsAndTrailingComment(t *testing.T) {
+	jqInst := New()
+	defer jqInst.Close()
+
+	err := jqInst.CompileProgramWithVars(".foo > $min # compare with the minimum", []string{"min"})
+	assert.Nil(t, err)
+	err = jqInst.CompileProgramWithVars(".foo >\n# compare with the minimum\n$max", []string{"min"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "at <top-level>, line 3")
+	assert.NotContains(t, err.Error(), ".[1] as")
+}
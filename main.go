@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"flag"
+	"fmt"
+	"github.com/sandro-h/prom_rest_exporter/scrape"
 	"github.com/sandro-h/prom_rest_exporter/server"
 	"github.com/sandro-h/prom_rest_exporter/spec"
+	"github.com/sandro-h/prom_rest_exporter/version"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
@@ -12,13 +15,19 @@ import (
 var debug = flag.Bool("debug", false, "Enables detailed debug logging")
 var trace = flag.Bool("trace", false, "Enables most detailed trace logging. Overrides the debug flag.")
 var config = flag.String("config", "prom_rest_exporter.yml", "Set path to config yaml file. Default: prom_rest_exporter.yml")
+var printVersion = flag.Bool("version", false, "Prints version information and exits")
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Printf("prom_rest_exporter version %s (revision %s, %s)\n", version.Version, version.Revision, version.GoVersion)
+		return
+	}
+
 	logFile := initLogging()
 	defer logFile.Close()
 
-	log.Infof("Starting prom_rest_exporter with config file %s", *config)
+	log.Infof("Starting prom_rest_exporter %s (revision %s) with config file %s", version.Version, version.Revision, *config)
 
 	spec, err := spec.ReadSpecFromYamlFile(*config)
 	if err != nil {
@@ -26,6 +35,14 @@ func main() {
 		panic(err)
 	}
 
+	if spec.StateFile != "" {
+		err = scrape.LoadCounterState(spec.StateFile)
+		if err != nil {
+			log.Errorf("Error loading state file %s: %s", spec.StateFile, err)
+			panic(err)
+		}
+	}
+
 	var ct int
 	if spec.CacheTimeSeconds > 0 {
 		ct = spec.CacheTimeSeconds
@@ -33,9 +50,8 @@ func main() {
 		ct = 60
 	}
 
-	for _, ep := range spec.Endpoints {
-		srv := server.MetricServer{Endpoint: ep, DefaultCacheTimeSeconds: ct}
-		go srv.Start()
+	for _, l := range server.NewListeners(spec, ct) {
+		go l.Start()
 	}
 
 	reader := bufio.NewReader(os.Stdin)
@@ -0,0 +1,318 @@
+// Package purejq provides the API of package jq on top of gojq, a jq implementation in pure Go.
+// It can be used where cgo or libjq are not available.
+package purejq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/itchyny/gojq"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Jq represents a compiled jq program
+type Jq struct {
+	code *gojq.Code
+	// Variables of a program compiled with CompileProgramWithVars
+	varNames []string
+	// Set by SetLibrary
+	moduleLoader gojq.ModuleLoader
+	prelude      string
+}
+
+// New creates a new instance of Jq
+func New() *Jq {
+	return new(Jq)
+}
+
+// Close frees the resources associated with this Jq instance
+func (jq *Jq) Close() {
+	jq.code = nil
+}
+
+// CompileProgram compiles a jq program for the passed Jq instance
+func (jq *Jq) CompileProgram(prog string) error {
+	return jq.CompileProgramWithVars(prog, nil)
+}
+
+// SetLibrary makes the modules in paths available to programs compiled afterwards, and prepends the prelude
+// to them, e.g. include directives and function definitions. Compile errors in the prelude are reported
+// at <library>.
+func (jq *Jq) SetLibrary(paths []string, prelude string) {
+	jq.moduleLoader = gojq.NewModuleLoader(paths)
+	jq.prelude = prelude
+}
+
+// CompileProgramWithVars compiles a jq program which can use the variables $<name> for the passed names.
+// Their values are passed to ProcessInputJvWithVars.
+func (jq *Jq) CompileProgramWithVars(prog string, names []string) error {
+	query, err := gojq.Parse(prog)
+	if err != nil {
+		return compileError(err, "<top-level>", prog)
+	}
+	if jq.prelude != "" {
+		// The prelude is parsed on its own so that errors in the program keep their line numbers
+		lib, err := gojq.Parse(jq.prelude + "\n.")
+		if err != nil {
+			return compileError(err, "<library>", jq.prelude)
+		}
+		query.Imports = append(lib.Imports, query.Imports...)
+		query.FuncDefs = append(lib.FuncDefs, query.FuncDefs...)
+	}
+	vars := make([]string, len(names))
+	for i, n := range names {
+		vars[i] = "$" + n
+	}
+	// $ENV and env are empty in gojq without an environ loader
+	opts := []gojq.CompilerOption{gojq.WithVariables(vars), gojq.WithEnvironLoader(os.Environ)}
+	if jq.moduleLoader != nil {
+		opts = append(opts, gojq.WithModuleLoader(jq.moduleLoader))
+	}
+	jq.code, err = gojq.Compile(query, opts...)
+	if err != nil {
+		if modErr, ok := err.(queryParseError); ok {
+			file, contents, parseErr := modErr.QueryParseError()
+			return compileError(parseErr, file, contents)
+		}
+		return fmt.Errorf("jq: error: %s", err)
+	}
+	jq.varNames = names
+	return nil
+}
+
+// queryParseError is implemented by the errors of gojq for modules that cannot be parsed
+type queryParseError interface {
+	QueryParseError() (string, string, error)
+}
+
+// compileError formats a parse error in file with the line it occurred on, like jq does
+func compileError(err error, file string, contents string) error {
+	if tokErr, ok := err.(interface{ Token() (string, int) }); ok {
+		_, offset := tokErr.Token()
+		if offset > len(contents) {
+			offset = len(contents)
+		}
+		line := strings.Count(contents[:offset], "\n") + 1
+		return fmt.Errorf("jq: error: %s at %s, line %d", err, file, line)
+	}
+	return fmt.Errorf("jq: error: %s at %s", err, file)
+}
+
+// ProcessInput runs the previously compiled program of the Jq instance on the input
+func (jq *Jq) ProcessInput(input string) ([]*Jv, error) {
+	jvInput, err := Parse([]byte(input))
+	if err != nil {
+		return nil, err
+	}
+	return jq.processInput(jvInput, false)
+}
+
+// ProcessInputFirstOnly runs the previously compiled program of the Jq instance on the input
+// and only returns the first completed result.
+func (jq *Jq) ProcessInputFirstOnly(input string) ([]*Jv, error) {
+	jvInput, err := Parse([]byte(input))
+	if err != nil {
+		return nil, err
+	}
+	return jq.processInput(jvInput, true)
+}
+
+// ProcessInputJv runs the previously compiled program of the Jq instance on the parsed input.
+// Must not be called concurrently for the same input.
+func (jq *Jq) ProcessInputJv(input *Jv) ([]*Jv, error) {
+	return jq.processInput(input, false)
+}
+
+// ProcessInputJvWithVars runs a program compiled with CompileProgramWithVars on the parsed input.
+// vars is an object with the values of the variables. Must not be called concurrently for the same input.
+func (jq *Jq) ProcessInputJvWithVars(input *Jv, vars *Jv) ([]*Jv, error) {
+	obj, _ := vars.v.(map[string]interface{})
+	values := make([]interface{}, len(jq.varNames))
+	for i, n := range jq.varNames {
+		values[i] = obj[n]
+	}
+	return jq.processInput(input, false, values...)
+}
+
+func (jq *Jq) processInput(jvInput *Jv, firstOnly bool, vars ...interface{}) ([]*Jv, error) {
+	results := make([]*Jv, 0)
+	if jq.code == nil {
+		return results, nil
+	}
+
+	iter := jq.code.Run(jvInput.v, vars...)
+	for {
+		res, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, isErr := res.(error); isErr {
+			return nil, runtimeError(err)
+		}
+		results = append(results, &Jv{res})
+		if firstOnly {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// runtimeError formats an error of a running program like libjq. The errors of the error function
+// carry their value, which is used without the "error: " prefix of gojq.
+func runtimeError(err error) error {
+	valErr, ok := err.(gojq.ValueError)
+	if !ok {
+		return fmt.Errorf("jq: error: %s", err)
+	}
+	if s, ok := valErr.Value().(string); ok {
+		return fmt.Errorf("jq: error: %s", s)
+	}
+	data, jsonErr := json.Marshal(valErr.Value())
+	if jsonErr != nil {
+		return fmt.Errorf("jq: error: %s", err)
+	}
+	return fmt.Errorf("jq: error: %s", data)
+}
+
+// Parse parses json data
+func Parse(data []byte) (*Jv, error) {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("jq: error: %s", err)
+	}
+	return &Jv{v}, nil
+}
+
+// Jv represents a json value as used by gojq
+type Jv struct {
+	v interface{}
+}
+
+// NewJv wraps a value in the representation of encoding/json: nil, bool, float64, string,
+// []interface{} or map[string]interface{}
+func NewJv(v interface{}) *Jv {
+	return &Jv{v}
+}
+
+// Value returns the wrapped value. It must not be modified.
+func (jv *Jv) Value() interface{} {
+	return jv.v
+}
+
+func (jv *Jv) Copy() *Jv {
+	return jv
+}
+
+// Free does nothing, values are garbage collected. It exists for compatibility with package jq.
+func (jv *Jv) Free() *Jv {
+	return nil
+}
+
+func (jv *Jv) IsNumber() bool {
+	switch jv.v.(type) {
+	case int, float64, *big.Int:
+		return true
+	}
+	return false
+}
+
+func (jv *Jv) IsString() bool {
+	_, ok := jv.v.(string)
+	return ok
+}
+
+func (jv *Jv) IsNull() bool {
+	return jv.v == nil
+}
+
+func (jv *Jv) IsBoolean() bool {
+	_, ok := jv.v.(bool)
+	return ok
+}
+
+func (jv *Jv) IsObject() bool {
+	_, ok := jv.v.(map[string]interface{})
+	return ok
+}
+
+func (jv *Jv) IsArray() bool {
+	_, ok := jv.v.([]interface{})
+	return ok
+}
+
+// Len returns the length of an array
+func (jv *Jv) Len() int {
+	arr, _ := jv.v.([]interface{})
+	return len(arr)
+}
+
+// Index returns the i-th element of an array
+func (jv *Jv) Index(i int) *Jv {
+	arr, _ := jv.v.([]interface{})
+	if i < 0 || i >= len(arr) {
+		return &Jv{nil}
+	}
+	return &Jv{arr[i]}
+}
+
+// Keys returns the sorted keys of an object
+func (jv *Jv) Keys() []string {
+	obj, _ := jv.v.(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get returns the value of a key of an object, or nil if there is no such key
+func (jv *Jv) Get(key string) *Jv {
+	obj, _ := jv.v.(map[string]interface{})
+	val, ok := obj[key]
+	if !ok {
+		return nil
+	}
+	return &Jv{val}
+}
+
+// ToNumber returns an int for integral numbers in the range of a C int like libjq, float64 otherwise
+func (jv *Jv) ToNumber() interface{} {
+	var dbl float64
+	switch n := jv.v.(type) {
+	case int:
+		dbl = float64(n)
+	case float64:
+		dbl = n
+	case *big.Int:
+		dbl, _ = new(big.Float).SetInt(n).Float64()
+	}
+	if dbl > math.MaxInt32 || dbl < math.MinInt32 || dbl != math.Trunc(dbl) {
+		return dbl
+	}
+	return int(dbl)
+}
+
+// ToString returns a non-pretty-print string representation of the json value
+func (jv *Jv) ToString() string {
+	// Always use "raw" output: no quotes around strings
+	if str, ok := jv.v.(string); ok {
+		return str
+	}
+	data, err := gojq.Marshal(jv.v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// PrettyPrint pretty prints the json value to stdout
+func (jv *Jv) PrettyPrint() {
+	data, _ := json.MarshalIndent(jv.v, "", "  ")
+	fmt.Printf("%s\n", data)
+}
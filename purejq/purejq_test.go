@@ -0,0 +1,38 @@
+package purejq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// The behaviour shared with package jq is tested for all engines in package spec
+
+func TestNumberKinds(t *testing.T) {
+	jqInst := New()
+	defer jqInst.Close()
+
+	// gojq computes with int, float64 and *big.Int
+	jqInst.CompileProgram(".[0], .[1], .[0] * 1000000000, .[0] * 1000000000000 * 1000000000000")
+	results, err := jqInst.ProcessInput("[42, 1.5]")
+	assert.Nil(t, err)
+
+	expected := []interface{}{42, 1.5, float64(42000000000), float64(42e24)}
+	assert.Equal(t, len(expected), len(results))
+	for i, exp := range expected {
+		assert.True(t, results[i].IsNumber())
+		assert.Equal(t, exp, results[i].ToNumber())
+	}
+}
+
+func TestCompileErrorFormat(t *testing.T) {
+	jqInst := New()
+	defer jqInst.Close()
+
+	err := jqInst.CompileProgram(".a |\n (")
+	assert.NotNil(t, err)
+	assert.Regexp(t, `^jq: error: .+ at <top-level>, line 2$`, err.Error())
+
+	err = jqInst.CompileProgram("undefined_func")
+	assert.NotNil(t, err)
+	assert.Regexp(t, `^jq: error: function not defined: undefined_func/0`, err.Error())
+}
@@ -0,0 +1,153 @@
+package scrape
+
+import (
+	"github.com/sandro-h/prom_rest_exporter/spec"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// discoverer collects the numeric values of a json document as metrics
+type discoverer struct {
+	spec        *spec.AutoDiscoverSpec
+	maxFamilies int
+	families    []*MetricInstance
+	byName      map[string]*MetricInstance
+	dropped     map[string]bool
+}
+
+// discoverMetrics creates a metric for every numeric value in the parsed response of a target with auto_discover.
+// Returns the metrics in order of appearance and the number of metrics dropped because they exceeded max_families.
+// Does not consume doc.
+func discoverMetrics(t *spec.TargetSpec, doc spec.Value) ([]MetricInstance, int) {
+	d := discoverer{
+		spec:        t.AutoDiscover,
+		maxFamilies: t.AutoDiscover.MaxFamilies,
+		byName:      make(map[string]*MetricInstance),
+		dropped:     make(map[string]bool),
+	}
+	if d.maxFamilies == 0 {
+		d.maxFamilies = spec.DefaultMaxFamilies
+	}
+	d.walk(doc, nil, map[string]string{}, "")
+
+	if len(d.dropped) > 0 {
+		log.Warnf("Auto discovery of %s exceeds %d metrics, dropped %d", t.URL, d.maxFamilies, len(d.dropped))
+	}
+	metrics := make([]MetricInstance, 0, len(d.families))
+	for _, m := range d.families {
+		metrics = append(metrics, *m)
+	}
+	return metrics, len(d.dropped)
+}
+
+// walk visits val, which is reached by the object keys in path. Array elements are distinguished
+// by labels. skipKey is an object key already used as label, which is not visited.
+func (d *discoverer) walk(val spec.Value, path []string, labels map[string]string, skipKey string) {
+	switch {
+	case val.IsNumber():
+		d.add(path, val.ToNumber(), labels)
+	case val.IsObject():
+		for _, k := range val.Keys() {
+			if k == skipKey {
+				continue
+			}
+			child := val.Get(k)
+			d.walk(child, append(path[:len(path):len(path)], k), labels, "")
+			child.Free()
+		}
+	case val.IsArray():
+		lblName := d.arrayLabelName(path, labels)
+		for i := 0; i < val.Len(); i++ {
+			elem := val.Index(i)
+			elemLabels := copyLabels(labels)
+			elemLabels[lblName] = strconv.Itoa(i)
+			labelKey := ""
+			if elem.IsObject() {
+				labelKey = d.findLabelKey(elem, elemLabels, lblName)
+			}
+			d.walk(elem, path, elemLabels, labelKey)
+			elem.Free()
+		}
+	}
+}
+
+// arrayLabelName returns the label distinguishing the elements of an array. It is named
+// after the key of the array, or "index" for arrays without key.
+func (d *discoverer) arrayLabelName(path []string, labels map[string]string) string {
+	name := "index"
+	if len(path) > 0 {
+		name = sanitizeLabelName(path[len(path)-1])
+	}
+	if _, exists := labels[name]; exists {
+		// Nested arrays with the same key
+		name += "_" + strconv.Itoa(len(labels))
+	}
+	return name
+}
+
+// findLabelKey sets the array label to the value of the first label_keys key found in elem
+// instead of the element index, and returns that key.
+func (d *discoverer) findLabelKey(elem spec.Value, labels map[string]string, lblName string) string {
+	for _, k := range d.spec.LabelKeys {
+		v := elem.Get(k)
+		if v == nil {
+			continue
+		}
+		lblVal, ok := toLabelValue(v)
+		v.Free()
+		if ok {
+			labels[lblName] = lblVal
+			return k
+		}
+	}
+	return ""
+}
+
+func (d *discoverer) add(path []string, value interface{}, labels map[string]string) {
+	if !d.isIncluded(strings.Join(path, ".")) {
+		return
+	}
+
+	parts := path
+	if d.spec.Prefix != "" {
+		parts = append([]string{d.spec.Prefix}, path...)
+	}
+	if len(parts) == 0 {
+		return
+	}
+	name := sanitizeMetricName(strings.Join(parts, "_"))
+
+	m, ok := d.byName[name]
+	if !ok {
+		if len(d.families) >= d.maxFamilies {
+			d.dropped[name] = true
+			return
+		}
+		m = &MetricInstance{
+			values:     make([]MetricValue, 0),
+			MetricSpec: &spec.MetricSpec{Name: name, Type: "gauge"}}
+		d.byName[name] = m
+		d.families = append(d.families, m)
+	}
+	m.values = append(m.values, MetricValue{value: value, labelVals: copyLabels(labels)})
+}
+
+// isIncluded returns true if the dotted path matches one of the include patterns, if there are any,
+// and none of the exclude patterns.
+func (d *discoverer) isIncluded(path string) bool {
+	for _, re := range d.spec.ExcludeRegexes {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(d.spec.IncludeRegexes) == 0 {
+		return true
+	}
+	for _, re := range d.spec.IncludeRegexes {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package scrape
+
+import (
+	"fmt"
+	"github.com/sandro-h/prom_rest_exporter/selfmetrics"
+	"github.com/sandro-h/prom_rest_exporter/spec"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"unicode/utf8"
+)
+
+// endpointOptions are the relabeling and cardinality limits of an endpoint across all its targets
+type endpointOptions struct {
+	// name identifies the endpoint in the state of accumulated counters and derived samples
+	name string
+	// selfName identifies the endpoint in the self metrics, as host:port/path
+	selfName       string
+	relabelConfigs []*spec.RelabelConfig
+	maxSeries      int // 0 for no limit
+	maxLabelLength int // 0 for no limit
+	series         int // number of series kept so far
+}
+
+// newEndpointOptions returns the options of endpoint ep for scrapes requested on path
+func newEndpointOptions(ep *spec.EndpointSpec, path string) *endpointOptions {
+	return &endpointOptions{
+		name:           strconv.Itoa(ep.Port) + ep.MetricsPath(),
+		selfName:       fmt.Sprintf("%s:%d%s", ep.ListenHost(), ep.Port, path),
+		relabelConfigs: ep.RelabelConfigs,
+		maxSeries:      ep.MaxSeries,
+		maxLabelLength: ep.MaxLabelLength}
+}
+
+// countDropped adds the series dropped in a scrape to the self metrics, if the scrape is for an endpoint
+func (l *endpointOptions) countDropped(stats *extractStats) {
+	if l.selfName == "" {
+		return
+	}
+	for name, dropped := range stats.droppedSeries {
+		selfmetrics.DroppedSeries.WithLabelValues(l.selfName, name).Add(float64(dropped))
+	}
+}
+
+// apply relabels the series of metrics, truncates label values longer than max_label_length and drops the series
+// of metrics exceeding max_series, keeping earlier series in extraction order. Dropped series are added to stats.
+func (l *endpointOptions) apply(metrics []MetricInstance, stats *extractStats) []MetricInstance {
+	limited := make([]MetricInstance, 0, len(metrics))
+	for _, m := range metrics {
+		m.values = relabel(m.Name, m.values, l.relabelConfigs)
+		if len(m.values) == 0 {
+			continue
+		}
+		if l.maxLabelLength > 0 {
+			m.values = l.truncateLabels(m, stats)
+		}
+		if l.maxSeries > 0 && l.series+len(m.values) > l.maxSeries {
+			keep := l.maxSeries - l.series
+			log.Warnf("Endpoint exceeds %d series, dropped %d of metric %s", l.maxSeries, len(m.values)-keep, m.Name)
+			stats.droppedSeries[m.Name] += len(m.values) - keep
+			if keep == 0 {
+				continue
+			}
+			m.values = m.values[:keep]
+		}
+		l.series += len(m.values)
+		limited = append(limited, m)
+	}
+	return limited
+}
+
+// stateScope identifies the series of target t in the state of accumulated counters and derived samples.
+// Endpoints scraping the same url, and probes of a module, keep their own state.
+// The url is without user info, so that passwords do not end up in the state file.
+func (l *endpointOptions) stateScope(t *spec.TargetSpec) string {
+	return l.name + "|" + t.Module + "|" + t.RedactedURL()
+}
+
+// truncateLabels truncates the label values of the series of m. Series which then have the same labels as
+// an earlier series are dropped and added to stats.
+func (l *endpointOptions) truncateLabels(m MetricInstance, stats *extractStats) []MetricValue {
+	truncated := false
+	for _, v := range m.values {
+		for k, lblVal := range v.labelVals {
+			v.labelVals[k] = truncateLabelValue(lblVal, l.maxLabelLength)
+			truncated = truncated || len(v.labelVals[k]) < len(lblVal)
+		}
+	}
+	if !truncated {
+		return m.values
+	}
+
+	kept := make([]MetricValue, 0, len(m.values))
+	seen := make(map[string]bool, len(m.values))
+	for i := range m.values {
+		key := seriesKey("", m.MetricSpec, m.values, i)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, m.values[i])
+	}
+	if len(kept) < len(m.values) {
+		log.Warnf("Metric %s has %d series with the same labels after truncation to %d characters, dropped them",
+			m.Name, len(m.values)-len(kept), l.maxLabelLength)
+		stats.droppedSeries[m.Name] += len(m.values) - len(kept)
+	}
+	return kept
+}
+
+// truncateLabelValue cuts val to at most maxLen characters
+func truncateLabelValue(val string, maxLen int) string {
+	if utf8.RuneCountInString(val) <= maxLen {
+		return val
+	}
+	runes := []rune(val)
+	return string(runes[:maxLen])
+}
@@ -0,0 +1,71 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sandro-h/prom_rest_exporter/spec"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const defaultExecTimeoutSeconds = 30
+
+// execWaitDelay is how long to wait for the output after the command was killed,
+// in case a process outside its process group keeps it open
+const execWaitDelay = 2 * time.Second
+
+// execCommand runs the command of an exec:// target and returns its stdout and exit code.
+// The exit code is -1 if the command could not be started or was killed.
+func execCommand(t *spec.TargetSpec) ([]byte, int, error) {
+	var args []string
+	var env map[string]string
+	timeout := defaultExecTimeoutSeconds
+	if t.Exec != nil {
+		args = t.Exec.Args
+		env = t.Exec.Env
+		if t.Exec.TimeoutSeconds > 0 {
+			timeout = t.Exec.TimeoutSeconds
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, t.ExecCommand(), args...)
+	killProcessGroup(cmd)
+	cmd.WaitDelay = execWaitDelay
+	if len(env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, -1, fmt.Errorf("command timed out after %ds", timeout)
+	}
+	if err != nil {
+		exitCode := getExitCode(err)
+		if stderr.Len() > 0 {
+			return nil, exitCode, fmt.Errorf("%s: %s", err, stderr.String())
+		}
+		return nil, exitCode, err
+	}
+	return stdout.Bytes(), 0, nil
+}
+
+func getExitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package scrape
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup starts the command in its own process group and kills the whole group on timeout,
+// so that child processes of the command, e.g. of sh -c, do not outlive it
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
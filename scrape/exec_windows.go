@@ -0,0 +1,16 @@
+package scrape
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// killProcessGroup starts the command in its own process group and kills the process tree on timeout,
+// so that child processes of the command do not outlive it
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+}
@@ -0,0 +1,33 @@
+package scrape
+
+import (
+	"strings"
+)
+
+// sanitizeLabelName replaces all characters that are not allowed in Prometheus label names with underscores
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// sanitizeMetricName replaces all characters that are not allowed in Prometheus metric names with underscores
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+func sanitizeName(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package scrape
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"github.com/sandro-h/prom_rest_exporter/spec"
+	"strings"
+)
+
+// relabel applies the relabel configs to the labels of each value of the metric called name.
+// Values dropped by keep or drop actions are removed.
+func relabel(name string, vals []MetricValue, configs []*spec.RelabelConfig) []MetricValue {
+	if len(configs) == 0 {
+		return vals
+	}
+	kept := vals[:0]
+	for _, v := range vals {
+		if relabelValue(name, v.labelVals, configs) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// relabelValue changes labels in place. Returns false if the value must be dropped.
+func relabelValue(name string, labels map[string]string, configs []*spec.RelabelConfig) bool {
+	for _, c := range configs {
+		source := sourceValue(name, labels, c)
+		switch c.Action {
+		case spec.RelabelKeep:
+			if !c.RegexInst.MatchString(source) {
+				return false
+			}
+		case spec.RelabelDrop:
+			if c.RegexInst.MatchString(source) {
+				return false
+			}
+		case spec.RelabelReplace:
+			indexes := c.RegexInst.FindStringSubmatchIndex(source)
+			if indexes == nil {
+				continue
+			}
+			target := string(c.RegexInst.ExpandString(nil, c.TargetLabel, source, indexes))
+			res := string(c.RegexInst.ExpandString(nil, c.Replacement, source, indexes))
+			setLabel(labels, target, res)
+		case spec.RelabelLowercase:
+			setLabel(labels, c.TargetLabel, strings.ToLower(source))
+		case spec.RelabelHashMod:
+			sum := md5.Sum([]byte(source))
+			mod := binary.BigEndian.Uint64(sum[8:]) % c.Modulus
+			setLabel(labels, c.TargetLabel, fmt.Sprintf("%d", mod))
+		case spec.RelabelLabelMap:
+			for k, v := range copyLabels(labels) {
+				if c.RegexInst.MatchString(k) {
+					setLabel(labels, c.RegexInst.ReplaceAllString(k, c.Replacement), v)
+				}
+			}
+		case spec.RelabelLabelDrop:
+			for k := range copyLabels(labels) {
+				if c.RegexInst.MatchString(k) {
+					delete(labels, k)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// sourceValue joins the values of the source labels. The metric name is available as __name__.
+func sourceValue(name string, labels map[string]string, c *spec.RelabelConfig) string {
+	vals := make([]string, 0, len(c.SourceLabels))
+	for _, l := range c.SourceLabels {
+		if l == spec.MetricNameLabel {
+			vals = append(vals, name)
+		} else {
+			vals = append(vals, labels[l])
+		}
+	}
+	return strings.Join(vals, c.Separator)
+}
+
+// setLabel sets a label, or removes it if the value is empty like Prometheus does
+func setLabel(labels map[string]string, name string, val string) {
+	if val == "" {
+		delete(labels, name)
+	} else {
+		labels[name] = val
+	}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -2,12 +2,16 @@ package scrape
 
 import (
 	"crypto/tls"
-	"github.com/sandro-h/prom_rest_exporter/jq"
+	"github.com/sandro-h/prom_rest_exporter/selfmetrics"
 	"github.com/sandro-h/prom_rest_exporter/spec"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,9 +19,47 @@ var getNow = func() time.Time {
 	return time.Now()
 }
 
+// Jq instances must not be used concurrently. Compiled metric specs can be shared
+// between concurrent scrapes, e.g. when several probes use the same module.
+var extractLock sync.Mutex
+
 // ScrapeTargets calls the REST endpoints in the passed targets and extracts metrics
 func ScrapeTargets(ts []*spec.TargetSpec, inclMetaMetrics bool) []MetricInstance {
+	metrics, _ := ScrapeTargetsWithStatus(ts, inclMetaMetrics)
+	return metrics
+}
+
+// ScrapeTargetsWithStatus is like ScrapeTargets, but additionally returns
+// false if any of the targets could not be scraped
+func ScrapeTargetsWithStatus(ts []*spec.TargetSpec, inclMetaMetrics bool) ([]MetricInstance, bool) {
+	return scrapeTargets(ts, inclMetaMetrics, &endpointOptions{})
+}
+
+// ScrapeEndpointTargets is like ScrapeTargetsWithStatus, but uses the meta metrics
+// relabeling and cardinality limits options of the endpoint ep
+func ScrapeEndpointTargets(ep *spec.EndpointSpec, ts []*spec.TargetSpec) ([]MetricInstance, bool) {
+	return scrapeTargets(ts, ep.InclMetaMetrics, newEndpointOptions(ep, ep.MetricsPath()))
+}
+
+// ProbeEndpointTarget scrapes the target of a probe request like ScrapeEndpointTargets and adds
+// the metric probe_success, which is 0 if the target could not be scraped
+func ProbeEndpointTarget(ep *spec.EndpointSpec, t *spec.TargetSpec) ([]MetricInstance, bool) {
+	metrics, ok := scrapeTargets([]*spec.TargetSpec{t}, ep.InclMetaMetrics, newEndpointOptions(ep, spec.ProbePath))
+	success := 0
+	if ok {
+		success = 1
+	}
+	probeSuccess := NewWithIntValue("probe_success", success,
+		"Whether the target of the probe could be scraped", "gauge", "", "")
+	probeSuccess.renderPrefixes()
+	metrics = append(metrics, probeSuccess)
+	sort.Stable(byMetricName(metrics))
+	return metrics, ok
+}
+
+func scrapeTargets(ts []*spec.TargetSpec, inclMetaMetrics bool, opts *endpointOptions) ([]MetricInstance, bool) {
 	allMetrics := make([]MetricInstance, 0)
+	ok := true
 
 	var metas map[string]*MetricInstance
 	var metasPtr *map[string]*MetricInstance
@@ -26,15 +68,19 @@ func ScrapeTargets(ts []*spec.TargetSpec, inclMetaMetrics bool) []MetricInstance
 		metasPtr = &metas
 	}
 
+	evictStaleState()
 	for _, t := range ts {
-		metrics, err := scrapeTarget(t, metasPtr)
+		metrics, err := scrapeTarget(t, metasPtr, opts)
 		if err != nil {
 			log.Errorf("Error scraping target %s: %s", t.URL, err)
+			ok = false
 		} else {
 			allMetrics = append(allMetrics, *metrics...)
 		}
 	}
 
+	saveCounterState()
+
 	if inclMetaMetrics {
 		computeOverallMetaMetrics(metasPtr, &allMetrics)
 		for _, m := range metas {
@@ -42,116 +88,512 @@ func ScrapeTargets(ts []*spec.TargetSpec, inclMetaMetrics bool) []MetricInstance
 		}
 	}
 
-	return allMetrics
+	// Output must not depend on the order of map iterations
+	sort.Stable(byMetricName(allMetrics))
+	for i := range allMetrics {
+		allMetrics[i].renderPrefixes()
+	}
+	return allMetrics, ok
 }
 
-func scrapeTarget(t *spec.TargetSpec, metas *map[string]*MetricInstance) (*[]MetricInstance, error) {
+func scrapeTarget(t *spec.TargetSpec, metas *map[string]*MetricInstance, opts *endpointOptions) (*[]MetricInstance, error) {
 	log.Debugf("Scraping target %s", t.URL)
 	tm := getNow()
-	restResponse, err := fetch(t.URL, t.User, t.Password, &t.Headers, t.Insecure)
+	var restResponse []byte
+	var err error
+	if t.IsExec() {
+		var exitCode int
+		restResponse, exitCode, err = execCommand(t)
+		if metas != nil {
+			computeExecMetaMetrics(metas, t.URL, getNow().Sub(tm), exitCode)
+		}
+	} else {
+		restResponse, err = fetch(t.URL, t.User, t.Password, &t.Headers, t.IsInsecure())
+	}
 	fetchDuration := getNow().Sub(tm)
+	if t.Module != "" {
+		selfmetrics.FetchDuration.WithLabelValues("", t.Module).Observe(fetchDuration.Seconds())
+	} else {
+		selfmetrics.FetchDuration.WithLabelValues(t.RedactedURL(), "").Observe(fetchDuration.Seconds())
+	}
 	if err != nil {
 		return nil, err
 	}
 	log.Tracef("Data from %s: %s", t.URL, restResponse)
 
-	metrics, skippedMetrics := extractMetrics(t, &restResponse)
+	metrics := make([]MetricInstance, 0)
+	stats := &extractStats{skippedMetrics: make(map[string]int), droppedSeries: make(map[string]int)}
+	// Parse once and run all selectors on the parsed response
+	doc, err := t.Engine.Parse(restResponse)
+	if err != nil {
+		log.Errorf("Error parsing response of %s: %s", t.URL, err)
+		stats.skippedMetrics[skipInvalidResponse] = len(t.Metrics)
+	} else {
+		metrics = extractMetrics(t, doc, tm, opts.stateScope(t), stats)
+		if t.AutoDiscover != nil {
+			discovered, dropped := discoverMetrics(t, doc)
+			for _, m := range discovered {
+				m.values = relabel(m.Name, m.values, t.RelabelConfigs)
+				if len(m.values) > 0 {
+					metrics = append(metrics, m)
+				}
+			}
+			stats.skippedMetrics[skipMaxFamilies] += dropped
+		}
+		doc.Free()
+	}
+	metrics = opts.apply(metrics, stats)
+	opts.countDropped(stats)
 
 	if metas != nil {
-		computeTargetMetaMetrics(metas, t.URL, fetchDuration, skippedMetrics)
+		computeTargetMetaMetrics(metas, t.RedactedURL(), fetchDuration, stats)
 	}
 
-	return metrics, nil
+	return &metrics, nil
+}
+
+// Reasons for skipped metrics
+const (
+	// The response is no valid json
+	skipInvalidResponse = "invalid_response"
+	// A selector raised an error
+	skipSelectorError = "selector_error"
+	// The selectors found no valid value
+	skipNoValue = "no_value"
+	// The metric exceeded max_families
+	skipMaxFamilies = "max_families"
+)
+
+// skipReasons are all reasons in the order of the meta metric
+var skipReasons = []string{skipInvalidResponse, skipMaxFamilies, skipNoValue, skipSelectorError}
+
+// extractStats counts the problems while extracting the metrics of a target
+type extractStats struct {
+	// Number of metrics skipped, by reason
+	skippedMetrics map[string]int
+	labelFailures  int
+	// Number of series dropped because of cardinality limits, by metric name
+	droppedSeries map[string]int
 }
 
-func extractMetrics(t *spec.TargetSpec, restResponse *string) (*[]MetricInstance, int) {
+// Does not consume doc. now is the value of the $now variable of the selectors.
+// scope identifies the target in the state of accumulated and derived metrics.
+func extractMetrics(t *spec.TargetSpec, doc spec.Value, now time.Time, scope string, stats *extractStats) []MetricInstance {
+	extractLock.Lock()
+	defer extractLock.Unlock()
+
 	metrics := make([]MetricInstance, 0)
-	skippedMetrics := 0
+	vars, err := t.NewVars(now)
+	if err != nil {
+		log.Errorf("Error creating variables of %s: %s", t.URL, err)
+		stats.skippedMetrics[skipSelectorError] = len(t.Metrics)
+		return metrics
+	}
+	defer vars.Free()
 	for _, m := range t.Metrics {
-		baseVals, err := m.JqInst.ProcessInput(*restResponse)
+		tm := time.Now()
+		baseVals, err := m.JqInst.Run(doc, vars)
 		if err != nil {
 			log.Errorf("Error processing input of %s for metric %s: %s", t.URL, m.Name, err)
-			skippedMetrics++
+			stats.skippedMetrics[skipSelectorError]++
 		} else {
-			vals := extractFromBaseValues(m, &baseVals)
-			if len(*vals) > 0 {
-				val := MetricInstance{*vals, m}
-				metrics = append(metrics, val)
-			} else {
-				skippedMetrics++
+			families := []*spec.MetricSpec{m}
+			familyVals := map[string][]spec.Value{m.Name: baseVals}
+			if m.NameJqInst != nil {
+				var dropped int
+				families, familyVals, dropped = splitFamilies(m, baseVals, vars)
+				stats.skippedMetrics[skipMaxFamilies] += dropped
+			}
+			for _, fam := range families {
+				famVals := familyVals[fam.Name]
+				vals := extractFromBaseValues(fam, &famVals, vars, &stats.labelFailures)
+				if len(*vals) > 0 {
+					*vals = relabel(fam.Name, *vals, fam.RelabelConfigs)
+					*vals = relabel(fam.Name, *vals, t.RelabelConfigs)
+					if len(*vals) == 0 {
+						// All series dropped on purpose
+						continue
+					}
+				}
+				if fam.MaxSeries > 0 && len(*vals) > fam.MaxSeries {
+					log.Warnf("Metric %s exceeds %d series, dropped %d", fam.Name, fam.MaxSeries, len(*vals)-fam.MaxSeries)
+					stats.droppedSeries[fam.Name] += len(*vals) - fam.MaxSeries
+					*vals = (*vals)[:fam.MaxSeries]
+				}
+				if len(*vals) > 0 {
+					if fam.Mode == spec.ModeAccumulate {
+						accumulate(scope, fam, *vals)
+					}
+					if fam.Derive != "" {
+						*vals = derive(scope, fam, *vals)
+					}
+					// Derived metrics have no values on their first scrape
+					if len(*vals) > 0 {
+						val := MetricInstance{*vals, fam}
+						metrics = append(metrics, val)
+					}
+				} else {
+					stats.skippedMetrics[skipNoValue]++
+				}
 			}
 			freeResults(baseVals)
 		}
+		selfmetrics.JqEvalDuration.WithLabelValues(m.Name).Observe(time.Since(tm).Seconds())
 	}
 
-	return &metrics, skippedMetrics
+	return metrics
 }
 
-func extractFromBaseValues(m *spec.MetricSpec, baseVals *[]*jq.Jv) *[]MetricValue {
+// splitFamilies groups the base values of a metric with a dynamic name by the name computed from their name selector.
+// Returns one metric spec per name in order of appearance and the number of families dropped
+// because they exceeded the max_families of the metric.
+func splitFamilies(m *spec.MetricSpec, baseVals []spec.Value, vars spec.Value) ([]*spec.MetricSpec, map[string][]spec.Value, int) {
+	maxFamilies := m.MaxFamilies
+	if maxFamilies <= 0 {
+		maxFamilies = spec.DefaultMaxFamilies
+	}
+
+	families := make([]*spec.MetricSpec, 0)
+	familyVals := make(map[string][]spec.Value)
+	dropped := make(map[string]bool)
+	for _, base := range baseVals {
+		key, ok := getNameKey(m, base, vars)
+		if !ok {
+			continue
+		}
+		name := sanitizeMetricName(strings.Replace(m.Name, spec.NameKeyPlaceholder, key, -1))
+		if _, exists := familyVals[name]; !exists {
+			if len(families) >= maxFamilies {
+				dropped[name] = true
+				continue
+			}
+			fam := *m
+			fam.Name = name
+			fam.Description = strings.Replace(m.Description, spec.NameKeyPlaceholder, key, -1)
+			families = append(families, &fam)
+		}
+		familyVals[name] = append(familyVals[name], base)
+	}
+	if len(dropped) > 0 {
+		log.Warnf("Metric %s exceeds %d families, dropped %d", m.Name, maxFamilies, len(dropped))
+	}
+	return families, familyVals, len(dropped)
+}
+
+// Does not consume res. Returns the key to put into the dynamic name of the metric.
+func getNameKey(m *spec.MetricSpec, res spec.Value, vars spec.Value) (string, bool) {
+	nameResults, err := m.NameJqInst.Run(res, vars)
+	defer freeResults(nameResults)
+	if err != nil {
+		log.Errorf("Error getting name for metric %s: %s", m.Name, err)
+		return "", false
+	}
+	if len(nameResults) == 0 {
+		log.Errorf("Error getting name for metric %s: no value found", m.Name)
+		return "", false
+	}
+	key, ok := toLabelValue(nameResults[0])
+	if !ok || key == "" {
+		log.Errorf("Error getting name for metric %s: %s is not a valid name", m.Name, nameResults[0].ToString())
+		return "", false
+	}
+	return key, true
+}
+
+func extractFromBaseValues(m *spec.MetricSpec, baseVals *[]spec.Value, vars spec.Value, labelFailures *int) *[]MetricValue {
 	values := make([]MetricValue, 0)
-	for _, base := range *baseVals {
-		numVal := getNumericValue(m, base)
+	// The states of several values are told apart by the index of their value if no label selector does
+	stateIndex := m.Mode == spec.ModeStateSet && len(*baseVals) > 1 && !hasSelectorLabels(m)
+	for i, base := range *baseVals {
+		if m.Mode == spec.ModeStateSet {
+			states := getStateSetValues(m, base, vars, labelFailures)
+			if stateIndex {
+				for _, s := range states {
+					s.labelVals["val_index"] = strconv.Itoa(i)
+				}
+			}
+			values = append(values, states...)
+			continue
+		}
+		if m.Type == spec.TypeInfo {
+			values = append(values, getInfoValues(m, base, vars, labelFailures)...)
+			continue
+		}
+		numVal := getNumericValue(m, base, vars)
 		if numVal == nil {
 			log.Errorf("Error processing REST input for metric %s: no valid numeric value found", m.Name)
 		} else {
-			labels := getLabels(m, base)
-			values = append(values, MetricValue{numVal, labels})
+			labels, keep := getLabels(m, base, vars, labelFailures)
+			if keep {
+				values = append(values, MetricValue{value: numVal, labelVals: labels, timestamp: getTimestamp(m, base, vars)})
+			}
 		}
 	}
 	return &values
 }
 
 // Does not consume res. Returns int, float64, or nil
-func getNumericValue(m *spec.MetricSpec, res *jq.Jv) interface{} {
-	val := res
-	if m.ValJqInst != nil {
-		subResults, err := m.ValJqInst.ProcessInputJv(res)
-		defer freeResults(subResults)
-		if err != nil {
-			log.Errorf("Error getting value for metric %s: %s", m.Name, err)
-		}
-		if len(subResults) > 0 {
-			val = subResults[0]
-		} else {
-			val = nil
+func getNumericValue(m *spec.MetricSpec, res spec.Value, vars spec.Value) interface{} {
+	var numVal interface{}
+	withValue(m, res, vars, func(val spec.Value) {
+		numVal = toNumericValue(m, val)
+	})
+	return numVal
+}
+
+// toNumericValue returns numbers as they are and maps other values with the value_mapping
+// of the metric. Unmapped booleans are 1 or 0, other unmapped values get the default_value.
+func toNumericValue(m *spec.MetricSpec, val spec.Value) interface{} {
+	if val.IsNumber() {
+		return val.ToNumber()
+	}
+	if mapped, ok := m.ValueMapping[val.ToString()]; ok {
+		return fromFloat(mapped)
+	}
+	if val.IsBoolean() {
+		if val.ToString() == "true" {
+			return 1
 		}
+		return 0
 	}
-	if val != nil && val.IsNumber() {
-		return val.ToNumber()
+	if m.DefaultValue != nil {
+		return fromFloat(*m.DefaultValue)
 	}
 	return nil
 }
 
-func freeResults(res []*jq.Jv) {
+// Does not consume res. Returns one value per state of the metric,
+// 1 for the state selected from res and 0 for all others.
+func getStateSetValues(m *spec.MetricSpec, res spec.Value, vars spec.Value, labelFailures *int) []MetricValue {
+	var state string
+	found := false
+	withValue(m, res, vars, func(val spec.Value) {
+		state, found = toLabelValue(val)
+	})
+	if !found {
+		log.Errorf("Error processing REST input for metric %s: no state found", m.Name)
+		return nil
+	}
+
+	labels, keep := getLabels(m, res, vars, labelFailures)
+	if !keep {
+		return nil
+	}
+	ts := getTimestamp(m, res, vars)
+	known := false
+	values := make([]MetricValue, 0, len(m.States))
+	for _, s := range m.States {
+		stateLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			stateLabels[k] = v
+		}
+		// Metrics with dynamic names can have a : in the name of their family
+		stateLabels[sanitizeLabelName(m.Name)] = s
+		numVal := 0
+		if s == state {
+			numVal = 1
+			known = true
+		}
+		values = append(values, MetricValue{value: numVal, labelVals: stateLabels, timestamp: ts})
+	}
+	if !known {
+		log.Warnf("Metric %s has unknown state %s", m.Name, state)
+	}
+	return values
+}
+
+// hasSelectorLabels returns true if m has labels with a value extracted by a selector
+func hasSelectorLabels(m *spec.MetricSpec) bool {
+	for _, l := range m.Labels {
+		if l.FixedValue == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Does not consume res. Returns a value 1 labeled with the info_keys of the object res,
+// or all its keys with scalar values if there are no info_keys.
+func getInfoValues(m *spec.MetricSpec, res spec.Value, vars spec.Value, labelFailures *int) []MetricValue {
+	if !res.IsObject() {
+		log.Errorf("Error processing REST input for metric %s: %s is not an object", m.Name, res.ToString())
+		return nil
+	}
+	labels, keep := getLabels(m, res, vars, labelFailures)
+	if !keep {
+		return nil
+	}
+
+	keys := m.InfoKeys
+	if len(keys) == 0 {
+		keys = res.Keys()
+	}
+	for _, k := range keys {
+		name := sanitizeLabelName(k)
+		if _, exists := labels[name]; exists {
+			continue
+		}
+		val := res.Get(k)
+		if val == nil {
+			if len(m.InfoKeys) > 0 {
+				log.Errorf("Error getting label %s for metric %s: no such key", k, m.Name)
+				*labelFailures++
+			}
+			continue
+		}
+		if lblVal, ok := toLabelValue(val); ok {
+			labels[name] = lblVal
+		}
+		val.Free()
+	}
+	return []MetricValue{{value: 1, labelVals: labels, timestamp: getTimestamp(m, res, vars)}}
+}
+
+// Does not consume res. Calls f with the value selected by the val_selector of the metric,
+// or with res itself if there is none. f is not called if val_selector selects nothing.
+func withValue(m *spec.MetricSpec, res spec.Value, vars spec.Value, f func(val spec.Value)) {
+	if m.ValJqInst == nil {
+		f(res)
+		return
+	}
+	subResults, err := m.ValJqInst.Run(res, vars)
+	defer freeResults(subResults)
+	if err != nil {
+		log.Errorf("Error getting value for metric %s: %s", m.Name, err)
+	}
+	if len(subResults) > 0 {
+		f(subResults[0])
+	}
+}
+
+// Does not consume res. Returns the timestamp in milliseconds, or 0 if there is none.
+func getTimestamp(m *spec.MetricSpec, res spec.Value, vars spec.Value) int64 {
+	if m.TsJqInst == nil {
+		return 0
+	}
+	tsResults, err := m.TsJqInst.Run(res, vars)
+	defer freeResults(tsResults)
+	if err != nil {
+		log.Errorf("Error getting timestamp for metric %s: %s", m.Name, err)
+		return 0
+	}
+	if len(tsResults) == 0 {
+		return 0
+	}
+
+	ts, err := parseTimestamp(tsResults[0], m.TimestampFormat)
+	if err != nil {
+		log.Errorf("Error parsing timestamp for metric %s: %s", m.Name, err)
+		return 0
+	}
+	return ts
+}
+
+func parseTimestamp(val spec.Value, format string) (int64, error) {
+	switch format {
+	case "", spec.TimestampUnix, spec.TimestampUnixMs:
+		var num float64
+		if val.IsNumber() {
+			num = toFloat(val.ToNumber())
+		} else {
+			var err error
+			num, err = strconv.ParseFloat(val.ToString(), 64)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if format == spec.TimestampUnixMs {
+			return int64(num), nil
+		}
+		return int64(num * 1000), nil
+	case spec.TimestampRFC3339:
+		t, err := time.Parse(time.RFC3339Nano, val.ToString())
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	default:
+		t, err := time.Parse(format, val.ToString())
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+}
+
+func freeResults(res []spec.Value) {
 	for _, r := range res {
 		r.Free()
 	}
 }
 
-// Does not consume res
-func getLabels(m *spec.MetricSpec, res *jq.Jv) map[string]string {
+// Does not consume res. Returns the labels and false if the series must be dropped because of a missing label.
+// Labels that could not be extracted and are not covered by on_missing are added to failures.
+func getLabels(m *spec.MetricSpec, res spec.Value, vars spec.Value, failures *int) (map[string]string, bool) {
 	labels := make(map[string]string)
 	for _, l := range m.Labels {
 		if l.FixedValue != "" {
 			labels[l.Name] = l.FixedValue
-		} else {
-			lblResults, err := l.JqInst.ProcessInputJv(res)
-			if err != nil {
-				log.Errorf("Error getting label for metric %s: %s", m.Name, err)
-			} else {
-				if len(lblResults) > 0 && lblResults[0].IsString() {
-					labels[l.Name] = lblResults[0].ToString()
-				}
-				freeResults(lblResults)
+			continue
+		}
+
+		// Errors, e.g. of missing keys in CEL, are handled like missing values
+		lblResults, err := l.JqInst.Run(res, vars)
+		if err != nil {
+			log.Errorf("Error getting label %s for metric %s: %s", l.Name, m.Name, err)
+		}
+		val, found := "", false
+		if len(lblResults) > 0 {
+			val, found = toLabelValue(lblResults[0])
+			if !found && !lblResults[0].IsNull() {
+				log.Errorf("Error getting label %s for metric %s: %s is not a scalar", l.Name, m.Name, lblResults[0].ToString())
+			}
+		}
+		freeResults(lblResults)
+
+		if found {
+			labels[l.Name] = val
+			continue
+		}
+		switch l.OnMissing {
+		case spec.LabelEmpty:
+			labels[l.Name] = ""
+		case spec.LabelDefault:
+			labels[l.Name] = l.DefaultValue
+		case spec.LabelDropSeries:
+			*failures++
+			return labels, false
+		default:
+			*failures++
+		}
+	}
+	return labels, true
+}
+
+// toLabelValue returns strings as they are and numbers and booleans in their canonical string form.
+// Returns false for null, objects and arrays.
+func toLabelValue(val spec.Value) (string, bool) {
+	switch {
+	case val.IsString(), val.IsBoolean():
+		return val.ToString(), true
+	case val.IsNumber():
+		switch n := val.ToNumber().(type) {
+		case int:
+			return strconv.Itoa(n), true
+		case float64:
+			if n == math.Trunc(n) {
+				// Integers too large for ToNumber to return an int, written without exponent
+				return strconv.FormatFloat(n, 'f', -1, 64), true
 			}
+			return strconv.FormatFloat(n, 'g', -1, 64), true
 		}
 	}
-	return labels
+	return "", false
 }
 
 func computeTargetMetaMetrics(metas *map[string]*MetricInstance,
 	fetchURL string, fetchDuration time.Duration,
-	skippedMetrics int) {
+	stats *extractStats) {
 	addMetaMetric(metas,
 		NewWithIntValue("prom_rest_exp_response_time", int(fetchDuration/time.Millisecond),
 			"Response time from REST endpoint",
@@ -159,12 +601,54 @@ func computeTargetMetaMetrics(metas *map[string]*MetricInstance,
 			"url",
 			fetchURL))
 
+	for _, reason := range skipReasons {
+		skipped := NewWithIntValue("prom_rest_exp_skipped_metrics", stats.skippedMetrics[reason],
+			"Number of metrics skipped due to failures or invalid data, by reason",
+			"gauge",
+			"url",
+			fetchURL)
+		skipped.values[0].labelVals["reason"] = reason
+		addMetaMetric(metas, skipped)
+	}
+
 	addMetaMetric(metas,
-		NewWithIntValue("prom_rest_exp_skipped_metrics", skippedMetrics,
-			"Number of metrics skipped due to failures or invalid data",
+		NewWithIntValue("prom_rest_exp_label_failures", stats.labelFailures,
+			"Number of label values that could not be extracted",
 			"gauge",
 			"url",
 			fetchURL))
+
+	names := make([]string, 0, len(stats.droppedSeries))
+	for name := range stats.droppedSeries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dropped := NewWithIntValue("prom_rest_exp_dropped_series", stats.droppedSeries[name],
+			"Number of series dropped because they exceeded max_series",
+			"gauge",
+			"url",
+			fetchURL)
+		dropped.values[0].labelVals["metric"] = name
+		addMetaMetric(metas, dropped)
+	}
+}
+
+func computeExecMetaMetrics(metas *map[string]*MetricInstance,
+	execURL string, execDuration time.Duration, exitCode int) {
+	addMetaMetric(metas,
+		NewWithIntValue("prom_rest_exp_exec_duration", int(execDuration/time.Millisecond),
+			"Run time of exec:// target command",
+			"gauge",
+			"url",
+			execURL))
+
+	addMetaMetric(metas,
+		NewWithIntValue("prom_rest_exp_exec_exit_code", exitCode,
+			"Exit code of exec:// target command, -1 if it could not be run or timed out",
+			"gauge",
+			"url",
+			execURL))
 }
 
 func computeOverallMetaMetrics(metas *map[string]*MetricInstance, metrics *[]MetricInstance) {
@@ -204,19 +688,15 @@ func addMetaMetric(metas *map[string]*MetricInstance, m MetricInstance) {
 	}
 }
 
-// Fetch makes a request to the url and returns the response as a string
-func fetch(url string, user string, pwd string, headers *map[string]string, insecure bool) (string, error) {
+// fetch makes a request to the url, or reads a file:// url, and returns the body of the response
+func fetch(url string, user string, pwd string, headers *map[string]string, insecure bool) ([]byte, error) {
 	if strings.HasPrefix(url, "file://") {
-		data, err := ioutil.ReadFile(url[7:])
-		if err != nil {
-			return "", err
-		}
-		return string(data), nil
+		return ioutil.ReadFile(url[7:])
 	}
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if user != "" && pwd != "" {
@@ -231,21 +711,18 @@ func fetch(url string, user string, pwd string, headers *map[string]string, inse
 	client := createClient(insecure)
 	response, err := client.Do(req)
 	if err != nil {
-		return "", err
-	}
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(data), nil
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
 }
 
 func createClient(insecure bool) *http.Client {
 	if insecure {
-		defaultTransport := http.DefaultTransport.(*http.Transport)
-		tr := *defaultTransport
+		// Keep the timeouts and proxy settings of the default transport
+		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		return &http.Client{Transport: &tr}
+		return &http.Client{Transport: tr}
 	} else {
 		return &http.Client{}
 	}
@@ -1,12 +1,17 @@
 package scrape
 
 import (
-	"fmt"
+	"bufio"
 	"github.com/sandro-h/prom_rest_exporter/spec"
 	"io"
 	"sort"
+	"strconv"
+	"strings"
 )
 
+// Size of the buffer metrics are rendered into before they are written out
+const writeBufferSize = 32 * 1024
+
 type MetricInstance struct {
 	values []MetricValue
 	*spec.MetricSpec
@@ -15,6 +20,9 @@ type MetricInstance struct {
 type MetricValue struct {
 	value     interface{} // float64 or int
 	labelVals map[string]string
+	timestamp int64 // milliseconds, 0 if not set
+	// Rendered metric name and labels, set by renderPrefixes
+	prefix string
 }
 
 func NewWithIntValue(name string, value int, description string, metricType string, labelName string, labelVal string) MetricInstance {
@@ -32,74 +40,146 @@ func NewWithIntValue(name string, value int, description string, metricType stri
 			Type:        metricType}}
 }
 
-func (val *MetricInstance) Print(w io.Writer) {
-	val.print(w, false)
+// Print writes the metric in the Prometheus text format. Labels are sorted by name,
+// values are written in extraction order.
+func (m *MetricInstance) Print(w io.Writer) {
+	bw := bufio.NewWriterSize(w, writeBufferSize)
+	m.writeHeader(bw)
+	m.writeValues(bw, nil)
+	bw.WriteByte('\n')
+	bw.Flush()
 }
 
-func (val *MetricInstance) PrintSortedLabels(w io.Writer) {
-	val.print(w, true)
+// WriteMetrics writes all metrics in the Prometheus text format through one buffered writer.
+// Metrics must be sorted by name. Metrics of the same name, e.g. from several targets,
+// are written as one family.
+func WriteMetrics(w io.Writer, metrics []MetricInstance) error {
+	bw := bufio.NewWriterSize(w, writeBufferSize)
+	var scratch []byte
+	for i := range metrics {
+		if i == 0 || metrics[i].Name != metrics[i-1].Name {
+			metrics[i].writeHeader(bw)
+		}
+		scratch = metrics[i].writeValues(bw, scratch)
+		if i == len(metrics)-1 || metrics[i].Name != metrics[i+1].Name {
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
 }
 
-func (m *MetricInstance) print(w io.Writer, sortLabels bool) {
+// writeHeader writes the HELP and TYPE lines of the metric to w
+func (m *MetricInstance) writeHeader(w *bufio.Writer) {
 	if m.Description != "" {
-		fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Description)
+		w.WriteString("# HELP ")
+		w.WriteString(m.Name)
+		w.WriteByte(' ')
+		w.WriteString(helpEscaper.Replace(m.Description))
+		w.WriteByte('\n')
 	}
-	if m.Type != "" {
-		fmt.Fprintf(w, "# TYPE %s %s\n", m.Name, m.Type)
+	typ := m.Type
+	if typ == spec.TypeInfo {
+		// The Prometheus text format has no info type
+		typ = "gauge"
 	}
-
-	for i, val := range m.values {
-		// If there is more than 1 value for the metric, but no labels
-		// to distinguish them, add a label with the index.
-		needsValIndex := len(m.values) > 1 && (m.OnlyFixedLabels || len(val.labelVals) == 0)
-		lbls := val.formatLabelString(i, sortLabels, needsValIndex)
-		fmt.Fprintf(w, "%s%s %s\n", m.Name, lbls, val.formatVal())
+	if typ != "" {
+		w.WriteString("# TYPE ")
+		w.WriteString(m.Name)
+		w.WriteByte(' ')
+		w.WriteString(typ)
+		w.WriteByte('\n')
 	}
-	fmt.Fprintf(w, "\n")
 }
 
-func (val *MetricValue) formatLabelString(valIndex int, sortLabels bool, addValIndex bool) string {
-	lbls := ""
-	if len(val.labelVals) > 0 {
-		if sortLabels {
-			var keys []string
-			for k := range val.labelVals {
-				keys = append(keys, k)
-			}
-			sort.Strings(keys)
-			for _, n := range keys {
-				lbls = concatLabel(lbls, n, val.labelVals[n])
-			}
+// writeValues writes the values of the metric to w using scratch for formatting. Returns scratch for reuse.
+func (m *MetricInstance) writeValues(w *bufio.Writer, scratch []byte) []byte {
+	for i := range m.values {
+		val := &m.values[i]
+		scratch = scratch[:0]
+		if val.prefix != "" {
+			scratch = append(scratch, val.prefix...)
 		} else {
-			for n, v := range val.labelVals {
-				lbls = concatLabel(lbls, n, v)
-			}
+			scratch = m.appendPrefix(scratch, i)
 		}
+		scratch = append(scratch, ' ')
+		scratch = val.appendVal(scratch)
+		if val.timestamp != 0 {
+			scratch = append(scratch, ' ')
+			scratch = strconv.AppendInt(scratch, val.timestamp, 10)
+		}
+		scratch = append(scratch, '\n')
+		w.Write(scratch)
 	}
-	if addValIndex {
-		lbls = concatLabel(lbls, "val_index", fmt.Sprintf("%d", valIndex))
-	}
+	return scratch
+}
 
-	if lbls == "" {
-		return ""
+// renderPrefixes renders the name and labels of all values once,
+// so they are not rendered again on every request while the metric is cached.
+func (m *MetricInstance) renderPrefixes() {
+	for i := range m.values {
+		m.values[i].prefix = string(m.appendPrefix(nil, i))
 	}
-	return "{" + lbls + "}"
 }
 
-func concatLabel(lbls string, name string, val string) string {
-	if lbls != "" {
-		lbls += ","
+// If there is more than 1 value for the metric, but no labels
+// to distinguish them, a label with the index is added.
+func needsValIndex(m *spec.MetricSpec, vals []MetricValue, i int) bool {
+	return len(vals) > 1 && (m.OnlyFixedLabels || len(vals[i].labelVals) == 0)
+}
+
+// appendPrefix appends the metric name and the sorted labels of the i-th value to buf
+func (m *MetricInstance) appendPrefix(buf []byte, i int) []byte {
+	buf = append(buf, m.Name...)
+	val := &m.values[i]
+	addValIndex := needsValIndex(m.MetricSpec, m.values, i)
+
+	keys := make([]string, 0, len(val.labelVals)+1)
+	for k := range val.labelVals {
+		keys = append(keys, k)
 	}
-	return lbls + name + "=\"" + val + "\""
+	if addValIndex {
+		keys = append(keys, "val_index")
+	}
+	if len(keys) == 0 {
+		return buf
+	}
+	sort.Strings(keys)
+
+	buf = append(buf, '{')
+	for j, n := range keys {
+		if j > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, n...)
+		buf = append(buf, '=', '"')
+		if n == "val_index" && addValIndex {
+			buf = strconv.AppendInt(buf, int64(i), 10)
+		} else {
+			buf = append(buf, labelEscaper.Replace(val.labelVals[n])...)
+		}
+		buf = append(buf, '"')
+	}
+	return append(buf, '}')
 }
 
-func (mv *MetricValue) formatVal() string {
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+
+func (mv *MetricValue) appendVal(buf []byte) []byte {
 	switch v := mv.value.(type) {
 	case int:
-		return fmt.Sprintf("%d", v)
+		return strconv.AppendInt(buf, int64(v), 10)
 	case float64:
-		return fmt.Sprintf("%f", v)
+		return strconv.AppendFloat(buf, v, 'f', 6, 64)
 	default:
-		return "?"
+		return append(buf, '?')
 	}
 }
+
+// byMetricName sorts metrics by name. Use a stable sort to keep metrics
+// with the same name in the order of their targets.
+type byMetricName []MetricInstance
+
+func (a byMetricName) Len() int           { return len(a) }
+func (a byMetricName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMetricName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,222 @@
+package scrape
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sandro-h/prom_rest_exporter/spec"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleStateTimeout is how long the counter or previous sample of a series is kept after it was last scraped.
+// Probes can scrape any number of targets, so the state would otherwise grow without bound.
+const staleStateTimeout = 24 * time.Hour
+
+// counterState holds the accumulated values of metrics with mode accumulate, keyed by series.
+type counterState struct {
+	lock   sync.Mutex
+	values map[string]float64
+	seen   map[string]time.Time // last scrape of the series
+	path   string
+	dirty  bool
+}
+
+func newCounterState() *counterState {
+	return &counterState{values: make(map[string]float64), seen: make(map[string]time.Time)}
+}
+
+var counters = newCounterState()
+
+// sampleState holds the previous sample per series of metrics with derive delta or rate.
+type sampleState struct {
+	lock    sync.Mutex
+	samples map[string]sample
+}
+
+type sample struct {
+	value float64
+	time  time.Time
+}
+
+func newSampleState() *sampleState {
+	return &sampleState{samples: make(map[string]sample)}
+}
+
+var previousSamples = newSampleState()
+
+// LoadCounterState loads accumulated counter values from the file at path, if it exists,
+// and persists them to this file after every scrape that changed them.
+func LoadCounterState(path string) error {
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	counters.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &counters.values)
+	if err != nil {
+		return err
+	}
+	now := getNow()
+	for key := range counters.values {
+		counters.seen[key] = now
+	}
+	return nil
+}
+
+// accumulate adds the extracted values to the counters of their series
+// and replaces them with the new counter totals.
+func accumulate(scope string, m *spec.MetricSpec, vals []MetricValue) {
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	now := getNow()
+	for i := range vals {
+		key := seriesKey(scope, m, vals, i)
+		counters.seen[key] = now
+		delta := toFloat(vals[i].value)
+		if delta < 0 {
+			log.Warnf("Ignoring negative value %f for accumulated metric %s", delta, m.Name)
+			delta = 0
+		}
+		counters.values[key] += delta
+		counters.dirty = true
+		vals[i].value = fromFloat(counters.values[key])
+	}
+}
+
+// saveCounterState writes the counter values to the state file if they changed
+func saveCounterState() {
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	if counters.path == "" || !counters.dirty {
+		return
+	}
+	data, err := json.Marshal(counters.values)
+	if err == nil {
+		tmpPath := counters.path + ".tmp"
+		err = ioutil.WriteFile(tmpPath, data, 0600)
+		if err == nil {
+			err = os.Rename(tmpPath, counters.path)
+		}
+	}
+	if err != nil {
+		log.Errorf("Error saving counter state to %s: %s", counters.path, err)
+		return
+	}
+	counters.dirty = false
+}
+
+// evictStaleState removes the counters and previous samples of series not scraped for staleStateTimeout
+func evictStaleState() {
+	cutoff := getNow().Add(-staleStateTimeout)
+
+	counters.lock.Lock()
+	for key, seen := range counters.seen {
+		if seen.Before(cutoff) {
+			delete(counters.values, key)
+			delete(counters.seen, key)
+			counters.dirty = true
+		}
+	}
+	counters.lock.Unlock()
+
+	previousSamples.lock.Lock()
+	for key, prev := range previousSamples.samples {
+		if prev.time.Before(cutoff) {
+			delete(previousSamples.samples, key)
+		}
+	}
+	previousSamples.lock.Unlock()
+}
+
+// derive replaces the extracted values with the delta or rate to the previous sample of their series.
+// Values without previous sample are dropped. If a value is lower than its previous sample, the
+// series is assumed to have been reset and the delta is the value itself.
+func derive(scope string, m *spec.MetricSpec, vals []MetricValue) []MetricValue {
+	previousSamples.lock.Lock()
+	defer previousSamples.lock.Unlock()
+
+	now := getNow()
+	derived := make([]MetricValue, 0, len(vals))
+	for i := range vals {
+		key := seriesKey(scope, m, vals, i)
+		cur := toFloat(vals[i].value)
+		prev, found := previousSamples.samples[key]
+		previousSamples.samples[key] = sample{cur, now}
+		if !found {
+			continue
+		}
+
+		delta := cur - prev.value
+		if delta < 0 {
+			log.Debugf("Detected reset of series %s", key)
+			delta = cur
+		}
+
+		val := vals[i]
+		if m.Derive == spec.DeriveRate {
+			elapsed := now.Sub(prev.time).Seconds()
+			if elapsed <= 0 {
+				continue
+			}
+			val.value = delta / elapsed
+		} else {
+			val.value = fromFloat(delta)
+		}
+		derived = append(derived, val)
+	}
+	return derived
+}
+
+// seriesKey identifies the series of the i-th value of a metric in scope, see endpointOptions.stateScope
+func seriesKey(scope string, m *spec.MetricSpec, vals []MetricValue, i int) string {
+	names := make([]string, 0, len(vals[i].labelVals))
+	for n := range vals[i].labelVals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(scope)
+	b.WriteString("|")
+	b.WriteString(m.Name)
+	for _, n := range names {
+		fmt.Fprintf(&b, "|%s=%s", n, vals[i].labelVals[n])
+	}
+	if needsValIndex(m, vals, i) {
+		fmt.Fprintf(&b, "|val_index=%d", i)
+	}
+	return b.String()
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
+
+// fromFloat returns an int for integral values, so they are printed without decimals
+func fromFloat(v float64) interface{} {
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return int(v)
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+// Package selfmetrics instruments prom_rest_exporter itself.
+// The metrics are registered in Registry and served on an internal path of every port.
+package selfmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sandro-h/prom_rest_exporter/version"
+)
+
+// Registry contains the process and Go runtime metrics and all metrics of this package
+var Registry = prometheus.NewRegistry()
+
+var (
+	ScrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "prom_rest_exporter_scrape_duration_seconds",
+		Help: "Duration of scraping all targets of an endpoint",
+	}, []string{"endpoint"})
+
+	// Probe targets are passed by the requests, so their fetches are labeled by module instead of url
+	FetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "prom_rest_exporter_fetch_duration_seconds",
+		Help: "Duration of fetching the data of a target, by url without user and password or by probe module",
+	}, []string{"url", "module"})
+
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prom_rest_exporter_cache_requests_total",
+		Help: "Number of metric requests served from cache (result=hit) or by scraping (result=miss)",
+	}, []string{"endpoint", "result"})
+
+	JqEvalDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prom_rest_exporter_jq_eval_duration_seconds",
+		Help:    "Duration of evaluating the jq selectors of a metric",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"metric"})
+
+	DroppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prom_rest_exporter_dropped_series_total",
+		Help: "Number of series dropped because of max_series, or because their labels collided after max_label_length truncation",
+	}, []string{"endpoint", "metric"})
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prom_rest_exporter_build_info",
+		Help: "A metric with a constant '1' value labeled by version, revision and goversion of prom_rest_exporter",
+	}, []string{"version", "revision", "goversion"})
+)
+
+func init() {
+	buildInfo.WithLabelValues(version.Version, version.Revision, version.GoVersion).Set(1)
+
+	Registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		ScrapeDuration,
+		FetchDuration,
+		CacheRequests,
+		JqEvalDuration,
+		DroppedSeries,
+		buildInfo)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+// Hash compared for unknown users, so that they take as long to reject as wrong passwords
+const unknownUserHash = "$2a$10$VUTSpYzQF/dtyDBlqzVc2ucC.XVQv...JkIx0n2ZD4AkzRcJP2KW."
+
+// basicAuth only passes requests to next if they have valid credentials for one of the users.
+// users maps user names to bcrypt password hashes.
+func basicAuth(next http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pwd, ok := r.BasicAuth()
+		if ok {
+			hash, known := users[user]
+			if !known {
+				hash = unknownUserHash
+			}
+			err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd))
+			if known && err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="prom_rest_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
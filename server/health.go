@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	HealthyPath     = "/-/healthy"
+	ReadyPath       = "/-/ready"
+	SelfMetricsPath = "/-/metrics"
+)
+
+// readiness tracks how many endpoints still wait for their first successful scrape
+type readiness struct {
+	pending int32
+}
+
+func (r *readiness) isReady() bool {
+	return r == nil || atomic.LoadInt32(&r.pending) <= 0
+}
+
+func (r *readiness) scrapeSucceeded() {
+	atomic.AddInt32(&r.pending, -1)
+}
+
+func getHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Healthy\n")
+}
+
+func (l *Listener) getReady(w http.ResponseWriter, r *http.Request) {
+	if l.readiness.isReady() {
+		fmt.Fprintf(w, "Ready\n")
+	} else {
+		http.Error(w, "Waiting for first successful scrape", http.StatusServiceUnavailable)
+	}
+}
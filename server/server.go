@@ -1,29 +1,127 @@
 package server
 
 import (
+	"compress/gzip"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sandro-h/prom_rest_exporter/scrape"
+	"github.com/sandro-h/prom_rest_exporter/selfmetrics"
 	"github.com/sandro-h/prom_rest_exporter/spec"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// MetricServer serves the metrics of one endpoint
 type MetricServer struct {
 	Endpoint                *spec.EndpointSpec
 	DefaultCacheTimeSeconds int
-	srv                     *http.Server
+	Modules                 map[string]*spec.TargetSpec
 	cache                   *cache.Cache
+	readiness               *readiness
+	scraped                 int32
+	name                    string
+	probeName               string
 }
 
+// Listener serves one or more endpoints sharing the same host and port
+type Listener struct {
+	Host      string
+	Port      int
+	Servers   []*MetricServer
+	WebConfig *spec.WebConfig
+	srv       *http.Server
+	readiness *readiness
+}
+
+// NewListeners creates one listener per distinct port of the endpoints in the spec
+// If ready_after_scrape is enabled, the listeners only report ready once all endpoints
+// with targets completed a successful scrape.
+func NewListeners(ex *spec.ExporterSpec, defaultCacheTimeSeconds int) []*Listener {
+	var rd *readiness
+	if ex.ReadyAfterScrape {
+		rd = &readiness{}
+	}
+
+	listeners := make([]*Listener, 0)
+	byPort := make(map[int]*Listener)
+	for _, ep := range ex.Endpoints {
+		l, ok := byPort[ep.Port]
+		if !ok {
+			l = &Listener{Host: ep.ListenHost(), Port: ep.Port, WebConfig: ex.WebConfig, readiness: rd}
+			byPort[ep.Port] = l
+			listeners = append(listeners, l)
+		}
+		srv := &MetricServer{
+			Endpoint:                ep,
+			DefaultCacheTimeSeconds: defaultCacheTimeSeconds,
+			Modules:                 ep.Modules}
+		if rd != nil && len(ep.Targets) > 0 {
+			srv.readiness = rd
+			rd.pending++
+		}
+		l.Servers = append(l.Servers, srv)
+	}
+	return listeners
+}
+
+// Start starts a listener serving only this endpoint
 func (srv *MetricServer) Start() {
-	host := "localhost"
-	if srv.Endpoint.Host != "" {
-		host = srv.Endpoint.Host
+	l := Listener{
+		Host:    srv.Endpoint.ListenHost(),
+		Port:    srv.Endpoint.Port,
+		Servers: []*MetricServer{srv}}
+	l.Start()
+}
+
+func (l *Listener) Start() {
+	router := mux.NewRouter()
+	router.HandleFunc(HealthyPath, getHealthy).Methods("GET")
+	router.HandleFunc(ReadyPath, l.getReady).Methods("GET")
+	router.Handle(SelfMetricsPath, promhttp.HandlerFor(selfmetrics.Registry, promhttp.HandlerOpts{})).Methods("GET")
+	for _, srv := range l.Servers {
+		srv.register(router, l.Host, l.Port)
+		if srv.readiness != nil {
+			// Scrape right away, so the listener can become ready without waiting for Prometheus
+			go srv.getMetrics()
+		}
+	}
+
+	var handler http.Handler = router
+	if l.WebConfig != nil && len(l.WebConfig.BasicAuthUsers) > 0 {
+		handler = basicAuth(router, l.WebConfig.BasicAuthUsers)
 	}
-	log.Infof("Starting metric endpoint at %s:%d/metrics", host, srv.Endpoint.Port)
+
+	l.srv = &http.Server{
+		Handler:      handler,
+		Addr:         fmt.Sprintf("%s:%d", l.Host, l.Port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	var err error
+	if l.WebConfig != nil && l.WebConfig.TLSServerConfig != nil {
+		l.srv.TLSConfig, err = l.WebConfig.TLSServerConfig.TLSConfig()
+		if err == nil {
+			err = l.srv.ListenAndServeTLS(l.WebConfig.TLSServerConfig.CertFile, l.WebConfig.TLSServerConfig.KeyFile)
+		}
+	} else {
+		err = l.srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("Error serving on %s: %s", l.srv.Addr, err)
+	}
+}
+
+func (srv *MetricServer) register(router *mux.Router, host string, port int) {
+	path := srv.Endpoint.MetricsPath()
+	srv.name = fmt.Sprintf("%s:%d%s", host, port, path)
+	log.Infof("Starting metric endpoint at %s", srv.name)
 
 	var ct time.Duration
 	if srv.Endpoint.CacheTimeSeconds > 0 {
@@ -34,31 +132,99 @@ func (srv *MetricServer) Start() {
 	log.Debugf("Using %ds cache time", ct)
 	srv.cache = cache.New(ct*time.Second, 10*time.Minute)
 
-	router := mux.NewRouter()
-	router.HandleFunc("/metrics", srv.GetMetrics).Methods("GET")
-
-	srv.srv = &http.Server{
-		Handler:      router,
-		Addr:         fmt.Sprintf("%s:%d", host, srv.Endpoint.Port),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	router.HandleFunc(path, srv.GetMetrics).Methods("GET")
+	if srv.Endpoint.Probe {
+		srv.probeName = fmt.Sprintf("%s:%d%s", host, port, spec.ProbePath)
+		log.Infof("Starting probe endpoint at %s", srv.probeName)
+		router.HandleFunc(spec.ProbePath, srv.GetProbe).Methods("GET")
 	}
-	srv.srv.ListenAndServe()
 }
 
 func (srv *MetricServer) GetMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 
-	var vals []scrape.MetricInstance
+	writeMetrics(w, r, srv.getMetrics())
+}
+
+func (srv *MetricServer) getMetrics() []scrape.MetricInstance {
 	cachedVals, found := srv.cache.Get("metrics")
 	if found {
+		selfmetrics.CacheRequests.WithLabelValues(srv.name, "hit").Inc()
+		return cachedVals.([]scrape.MetricInstance)
+	}
+	selfmetrics.CacheRequests.WithLabelValues(srv.name, "miss").Inc()
+
+	tm := time.Now()
+	vals, ok := scrape.ScrapeEndpointTargets(srv.Endpoint, srv.Endpoint.Targets)
+	selfmetrics.ScrapeDuration.WithLabelValues(srv.name).Observe(time.Since(tm).Seconds())
+	srv.cache.Set("metrics", vals, cache.DefaultExpiration)
+	if ok && srv.readiness != nil && atomic.CompareAndSwapInt32(&srv.scraped, 0, 1) {
+		srv.readiness.scrapeSucceeded()
+	}
+	return vals
+}
+
+// GetProbe scrapes the target passed as query parameter using the metrics of the passed module
+func (srv *MetricServer) GetProbe(w http.ResponseWriter, r *http.Request) {
+	moduleName := r.URL.Query().Get("module")
+	module, ok := srv.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module '%s'", moduleName), http.StatusBadRequest)
+		return
+	}
+	targetURL := r.URL.Query().Get("target")
+	if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
+		http.Error(w, "Parameter 'target' must be a http:// or https:// url", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	var vals []scrape.MetricInstance
+	cacheKey := "probe:" + moduleName + ":" + targetURL
+	cachedVals, found := srv.cache.Get(cacheKey)
+	if found {
+		selfmetrics.CacheRequests.WithLabelValues(srv.probeName, "hit").Inc()
 		vals = cachedVals.([]scrape.MetricInstance)
 	} else {
-		vals = scrape.ScrapeTargets(srv.Endpoint.Targets, srv.Endpoint.InclMetaMetrics)
-		srv.cache.Set("metrics", vals, cache.DefaultExpiration)
+		selfmetrics.CacheRequests.WithLabelValues(srv.probeName, "miss").Inc()
+		target := *module
+		target.URL = targetURL
+		target.Module = moduleName
+		tm := time.Now()
+		var ok bool
+		vals, ok = scrape.ProbeEndpointTarget(srv.Endpoint, &target)
+		selfmetrics.ScrapeDuration.WithLabelValues(srv.probeName).Observe(time.Since(tm).Seconds())
+		// Failed probes are retried on the next request
+		if ok {
+			srv.cache.Set(cacheKey, vals, cache.DefaultExpiration)
+		}
 	}
 
-	for _, val := range vals {
-		val.Print(w)
+	writeMetrics(w, r, vals)
+}
+
+// writeMetrics writes the metrics to the response, gzipped if the client accepts it
+func writeMetrics(w http.ResponseWriter, r *http.Request, vals []scrape.MetricInstance) {
+	var out io.Writer = w
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	err := scrape.WriteMetrics(out, vals)
+	if err != nil {
+		log.Debugf("Error writing metrics: %s", err)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(enc, ";")[0]) == "gzip" {
+			return true
+		}
 	}
+	return false
 }
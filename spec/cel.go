@@ -0,0 +1,94 @@
+package spec
+
+import (
+	"github.com/google/cel-go/cel"
+	"google.golang.org/protobuf/types/known/structpb"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// CELInputVariable is the variable holding the input of CEL selectors
+const CELInputVariable = "self"
+
+// celEnvs caches the CEL environments by their variable names
+var celEnvs = struct {
+	lock sync.Mutex
+	envs map[string]*cel.Env
+}{envs: make(map[string]*cel.Env)}
+
+// celSelector evaluates a CEL expression with the input bound to self
+type celSelector struct {
+	engine  Engine
+	program cel.Program
+	hasVars bool
+}
+
+func getCELEnv(varNames []string) (*cel.Env, error) {
+	celEnvs.lock.Lock()
+	defer celEnvs.lock.Unlock()
+	key := strings.Join(varNames, ",")
+	if env, ok := celEnvs.envs[key]; ok {
+		return env, nil
+	}
+	opts := []cel.EnvOption{cel.Variable(CELInputVariable, cel.DynType)}
+	for _, name := range varNames {
+		opts = append(opts, cel.Variable(name, cel.DynType))
+	}
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+	celEnvs.envs[key] = env
+	return env, nil
+}
+
+func compileCEL(engine Engine, selector string, varNames []string) (Selector, error) {
+	env, err := getCELEnv(varNames)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(selector)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return celSelector{engine, program, len(varNames) > 0}, nil
+}
+
+// Run returns the result of the expression. Lists yield one result per element like jq's .[]
+func (s celSelector) Run(input Value, vars Value) ([]Value, error) {
+	native, err := toNative(input)
+	if err != nil {
+		return nil, err
+	}
+	activation := map[string]interface{}{}
+	if s.hasVars && vars != nil {
+		nativeVars, err := toNative(vars)
+		if err != nil {
+			return nil, err
+		}
+		if obj, ok := nativeVars.(map[string]interface{}); ok {
+			for name, val := range obj {
+				activation[name] = val
+			}
+		}
+	}
+	activation[CELInputVariable] = native
+	out, _, err := s.program.Eval(activation)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := out.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, err
+	}
+	result := pb.(*structpb.Value).AsInterface()
+	if list, ok := result.([]interface{}); ok {
+		return fromNatives(s.engine, list)
+	}
+	return fromNatives(s.engine, []interface{}{result})
+}
@@ -0,0 +1,95 @@
+package spec
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Selector engines
+const (
+	// EngineJq runs selectors with libjq through cgo
+	EngineJq = "jq"
+	// EngineGoJq runs selectors with gojq, a jq implementation in pure Go
+	EngineGoJq = "gojq"
+)
+
+// Value is a json value that selectors run on
+type Value interface {
+	IsNumber() bool
+	IsString() bool
+	IsBoolean() bool
+	IsNull() bool
+	IsObject() bool
+	IsArray() bool
+	// ToNumber returns int for integral numbers, float64 otherwise
+	ToNumber() interface{}
+	// ToString returns strings without quotes and other values as compact json
+	ToString() string
+	// Keys returns the sorted keys of an object
+	Keys() []string
+	// Get returns the value of a key of an object, or nil if there is no such key. The returned value must be freed.
+	Get(key string) Value
+	// Len returns the length of an array
+	Len() int
+	// Index returns the i-th element of an array. The returned value must be freed.
+	Index(i int) Value
+	Free()
+}
+
+// Selector is a compiled selector program
+type Selector interface {
+	// Run runs the selector on input, which is not consumed. vars is an object with the values of
+	// the variables the selector was compiled with, or nil if there are none. The results must be freed.
+	Run(input Value, vars Value) ([]Value, error)
+}
+
+// Library holds the jq modules and functions available to all jq selectors
+type Library struct {
+	// Paths to search for modules
+	Paths []string
+	// Prelude is prepended to every program, it includes the modules and defines the functions
+	Prelude string
+}
+
+// Engine compiles selectors and parses the responses they run on
+type Engine interface {
+	// Compile compiles a program which can use the variables $<name> for the passed names
+	// and the functions of lib, which may be nil
+	Compile(program string, varNames []string, lib *Library) (Selector, error)
+	// Parse parses json data. The returned value must be freed.
+	Parse(data []byte) (Value, error)
+}
+
+// engines holds the engines available in this build by name
+var engines = map[string]Engine{
+	EngineGoJq: goJqEngine{},
+}
+
+// DefaultEngine is the name of the engine used if the configuration sets none.
+// It is jq if the binary is built with cgo, gojq otherwise.
+var DefaultEngine = EngineGoJq
+
+// Engines returns the names of the engines available in this build
+func Engines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetEngine returns the engine with the given name, or the default engine if name is empty
+func GetEngine(name string) (Engine, error) {
+	if name == "" {
+		name = DefaultEngine
+	}
+	e, ok := engines[name]
+	if !ok {
+		if name == EngineJq {
+			return nil, fmt.Errorf("Engine %s is not available in this build, it requires cgo", name)
+		}
+		return nil, fmt.Errorf("Invalid engine %s", name)
+	}
+	return e, nil
+}
@@ -0,0 +1,77 @@
+package spec
+
+import (
+	"github.com/sandro-h/prom_rest_exporter/purejq"
+)
+
+type goJqEngine struct{}
+
+func (goJqEngine) Compile(program string, varNames []string, lib *Library) (Selector, error) {
+	inst := purejq.New()
+	if lib != nil {
+		inst.SetLibrary(lib.Paths, lib.Prelude)
+	}
+	err := inst.CompileProgramWithVars(program, varNames)
+	if err != nil {
+		return nil, err
+	}
+	return goJqSelector{inst}, nil
+}
+
+func (goJqEngine) Parse(data []byte) (Value, error) {
+	jv, err := purejq.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return goJqValue{jv}, nil
+}
+
+func (goJqEngine) FromNative(v interface{}) Value {
+	return goJqValue{purejq.NewJv(v)}
+}
+
+type goJqSelector struct {
+	inst *purejq.Jq
+}
+
+func (s goJqSelector) Run(input Value, vars Value) ([]Value, error) {
+	var results []*purejq.Jv
+	var err error
+	if vars == nil {
+		results, err = s.inst.ProcessInputJv(input.(goJqValue).Jv)
+	} else {
+		results, err = s.inst.ProcessInputJvWithVars(input.(goJqValue).Jv, vars.(goJqValue).Jv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(results))
+	for i, r := range results {
+		values[i] = goJqValue{r}
+	}
+	return values, nil
+}
+
+type goJqValue struct {
+	*purejq.Jv
+}
+
+func (v goJqValue) Get(key string) Value {
+	val := v.Jv.Get(key)
+	if val == nil {
+		return nil
+	}
+	return goJqValue{val}
+}
+
+func (v goJqValue) Index(i int) Value {
+	return goJqValue{v.Jv.Index(i)}
+}
+
+func (v goJqValue) Native() interface{} {
+	return v.Jv.Value()
+}
+
+func (v goJqValue) Free() {
+	v.Jv.Free()
+}
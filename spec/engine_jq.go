@@ -0,0 +1,77 @@
+//go:build cgo
+// +build cgo
+
+package spec
+
+import (
+	"github.com/sandro-h/prom_rest_exporter/jq"
+)
+
+func init() {
+	engines[EngineJq] = jqEngine{}
+	DefaultEngine = EngineJq
+}
+
+type jqEngine struct{}
+
+func (jqEngine) Compile(program string, varNames []string, lib *Library) (Selector, error) {
+	inst := jq.New()
+	if lib != nil {
+		inst.SetLibrary(lib.Paths, lib.Prelude)
+	}
+	err := inst.CompileProgramWithVars(program, varNames)
+	if err != nil {
+		return nil, err
+	}
+	return jqSelector{inst}, nil
+}
+
+func (jqEngine) Parse(data []byte) (Value, error) {
+	jv, err := jq.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return jqValue{jv}, nil
+}
+
+type jqSelector struct {
+	inst *jq.Jq
+}
+
+func (s jqSelector) Run(input Value, vars Value) ([]Value, error) {
+	var results []*jq.Jv
+	var err error
+	if vars == nil {
+		results, err = s.inst.ProcessInputJv(input.(jqValue).Jv)
+	} else {
+		results, err = s.inst.ProcessInputJvWithVars(input.(jqValue).Jv, vars.(jqValue).Jv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(results))
+	for i, r := range results {
+		values[i] = jqValue{r}
+	}
+	return values, nil
+}
+
+type jqValue struct {
+	*jq.Jv
+}
+
+func (v jqValue) Get(key string) Value {
+	val := v.Jv.Get(key)
+	if val == nil {
+		return nil
+	}
+	return jqValue{val}
+}
+
+func (v jqValue) Index(i int) Value {
+	return jqValue{v.Jv.Index(i)}
+}
+
+func (v jqValue) Free() {
+	v.Jv.Free()
+}
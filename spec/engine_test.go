@@ -0,0 +1,448 @@
+package spec
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The conformance tests run against every engine available in this build
+
+func forEachEngine(t *testing.T, f func(t *testing.T, engine Engine)) {
+	for _, name := range Engines() {
+		engine, err := GetEngine(name)
+		assert.Nil(t, err)
+		t.Run(name, func(t *testing.T) {
+			f(t, engine)
+		})
+	}
+}
+
+func runSelector(t *testing.T, engine Engine, program string, input string) []string {
+	sel, err := engine.Compile(program, nil, nil)
+	assert.Nil(t, err)
+	doc, err := engine.Parse([]byte(input))
+	assert.Nil(t, err)
+	defer doc.Free()
+
+	results, err := sel.Run(doc, nil)
+	assert.Nil(t, err)
+	strs := make([]string, 0, len(results))
+	for _, r := range results {
+		strs = append(strs, r.ToString())
+		r.Free()
+	}
+	return strs
+}
+
+func TestEngineSelectors(t *testing.T) {
+	input := `{"users": [
+		{"id": 1, "name": "George", "score": 1.5, "admin": true, "group": null},
+		{"id": 2, "name": "Janet", "score": 2, "admin": false, "tags": ["a", "b"]}],
+		"usage": {"cpu": 0.25, "disk": 3}}`
+	cases := []struct {
+		program  string
+		expected []string
+	}{
+		{".users[].name", []string{"George", "Janet"}},
+		{".users[] | select(.id % 2 == 0) | .name", []string{"Janet"}},
+		{".users | length", []string{"2"}},
+		{".users[].score", []string{"1.5", "2"}},
+		{".users[].admin", []string{"true", "false"}},
+		{".users[0].group", []string{"null"}},
+		{".users[1].tags", []string{`["a","b"]`}},
+		{".users[0] | {id, name}", []string{`{"id":1,"name":"George"}`}},
+		{".usage | to_entries[] | .key", []string{"cpu", "disk"}},
+		{".missing", []string{"null"}},
+		{`"say \"hi\" \\ ü"`, []string{`say "hi" \ ü`}},
+		{".users[] | .name | ascii_downcase", []string{"george", "janet"}},
+		{".users[], 1 | .id? // 0", []string{"1", "2", "0"}},
+	}
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		for _, c := range cases {
+			assert.Equal(t, c.expected, runSelector(t, engine, c.program, input), c.program)
+		}
+	})
+}
+
+func TestEngineRunRepeatedly(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		sel, err := engine.Compile(".[].bar", nil, nil)
+		assert.Nil(t, err)
+		inputs := []string{
+			`[{"foo": 7, "bar": "helloooo"},{"foo": 8, "bar": "world"}]`,
+			`[{"foo": 7, "bar": "yaya"},{"foo": 8, "bar": "baba"}]`}
+		outputs := [][]string{{"helloooo", "world"}, {"yaya", "baba"}}
+		for i, input := range inputs {
+			doc, err := engine.Parse([]byte(input))
+			assert.Nil(t, err)
+			// The same parsed input can be passed to a selector several times
+			for j := 0; j < 3; j++ {
+				results, err := sel.Run(doc, nil)
+				assert.Nil(t, err)
+				strs := make([]string, 0, len(results))
+				for _, r := range results {
+					strs = append(strs, r.ToString())
+					r.Free()
+				}
+				assert.Equal(t, outputs[i], strs)
+			}
+			doc.Free()
+		}
+	})
+}
+
+func TestEngineRuntimeErrors(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		for _, program := range []string{".users[] | .name + 1", ".users.foo", `error("broken")`} {
+			sel, err := engine.Compile(program, nil, nil)
+			assert.Nil(t, err)
+			doc, _ := engine.Parse([]byte(`{"users": [{"name": "George"}]}`))
+			results, err := sel.Run(doc, nil)
+			doc.Free()
+			assert.Nil(t, results, program)
+			assert.NotNil(t, err, program)
+			assert.Contains(t, err.Error(), "jq: error: ", program)
+		}
+
+		// Errors raised by the program read the same with every engine
+		cases := map[string]string{
+			`error("broken")`:      "jq: error: broken",
+			`.users[0] | error`:    `jq: error: {"name":"George"}`,
+			`"x" | error(. + "y")`: "jq: error: xy",
+		}
+		for program, expected := range cases {
+			sel, err := engine.Compile(program, nil, nil)
+			assert.Nil(t, err, program)
+			doc, _ := engine.Parse([]byte(`{"users": [{"name": "George"}]}`))
+			_, err = sel.Run(doc, nil)
+			doc.Free()
+			assert.NotNil(t, err, program)
+			assert.Equal(t, expected, err.Error(), program)
+		}
+	})
+}
+
+func TestEngineNumbers(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		doc, err := engine.Parse([]byte(`[42, -7, 1.5, 2.0, 3000000000]`))
+		assert.Nil(t, err)
+		defer doc.Free()
+
+		expected := []interface{}{42, -7, 1.5, 2, float64(3000000000)}
+		assert.Equal(t, len(expected), doc.Len())
+		for i, exp := range expected {
+			elem := doc.Index(i)
+			assert.True(t, elem.IsNumber())
+			assert.Equal(t, exp, elem.ToNumber())
+			elem.Free()
+		}
+	})
+}
+
+func TestEngineValueAccessors(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		doc, err := engine.Parse([]byte(`{"version": "1.2", "build": 42, "debug": false, "sha": null, "tags": ["a"]}`))
+		assert.Nil(t, err)
+		defer doc.Free()
+
+		assert.True(t, doc.IsObject())
+		assert.Equal(t, []string{"build", "debug", "sha", "tags", "version"}, doc.Keys())
+		assert.Nil(t, doc.Get("region"))
+
+		kinds := map[string]func(v Value) bool{
+			"version": Value.IsString,
+			"build":   Value.IsNumber,
+			"debug":   Value.IsBoolean,
+			"sha":     Value.IsNull,
+			"tags":    Value.IsArray,
+		}
+		for key, isKind := range kinds {
+			val := doc.Get(key)
+			assert.True(t, isKind(val), key)
+			val.Free()
+		}
+
+		version := doc.Get("version")
+		assert.Equal(t, "1.2", version.ToString())
+		version.Free()
+	})
+}
+
+func TestEngineParseInvalidInput(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		_, err := engine.Parse([]byte(`{"foo": `))
+		assert.NotNil(t, err)
+
+		_, err = engine.Parse(nil)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestEngineCompileInvalidProgram(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		_, err := engine.Compile(".(]", nil, nil)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "jq: error:")
+	})
+}
+
+func writeModule(t *testing.T, dir string, name string, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name+".jq"), []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestEngineLibrary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jqlib")
+	defer os.RemoveAll(dir)
+	writeModule(t, dir, "util", "def double: . * 2;\ndef inc: . + 1;\n")
+	lib := &Library{Paths: []string{dir}, Prelude: "include \"util\"; def pct:\n  . * 100;"}
+
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		sel, err := engine.Compile(".[] | double | inc | pct", nil, lib)
+		assert.Nil(t, err)
+		doc, _ := engine.Parse([]byte("[1, 2]"))
+		defer doc.Free()
+		results, err := sel.Run(doc, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(results))
+		assert.Equal(t, "300", results[0].ToString())
+		assert.Equal(t, "500", results[1].ToString())
+	})
+}
+
+func TestEngineDirectives(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jqlib")
+	defer os.RemoveAll(dir)
+	writeModule(t, dir, "util", "def double: . * 2;\n")
+	writeModule(t, dir, "units", "def pct: . * 100;\n")
+	lib := &Library{Paths: []string{dir}, Prelude: "include \"units\"; def inc: . + 1;"}
+
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		vars, _ := fromNative(engine, map[string]interface{}{"offset": 10})
+		defer vars.Free()
+		doc, _ := engine.Parse([]byte("[1, 2]"))
+		defer doc.Free()
+		programs := []string{
+			`include "util"; .[] | double | inc | pct + $offset`,
+			"# Helpers\nimport \"util\" as u;\n\n.[] | u::double | inc | pct + $offset",
+		}
+		for _, program := range programs {
+			sel, err := engine.Compile(program, []string{"offset"}, lib)
+			assert.Nil(t, err, program)
+			results, err := sel.Run(doc, vars)
+			assert.Nil(t, err, program)
+			strs := make([]string, 0, len(results))
+			for _, r := range results {
+				strs = append(strs, r.ToString())
+				r.Free()
+			}
+			assert.Equal(t, []string{"310", "510"}, strs, program)
+		}
+
+		_, err := engine.Compile("include \"util\";\n.[] |\n (", []string{"offset"}, lib)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "at <top-level>, line 3")
+	})
+}
+
+func TestEngineEnv(t *testing.T) {
+	os.Setenv("PROM_REST_EXPORTER_TEST_ENV", "staging")
+	defer os.Unsetenv("PROM_REST_EXPORTER_TEST_ENV")
+
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		assert.Equal(t, []string{"staging", "staging"},
+			runSelector(t, engine, "$ENV.PROM_REST_EXPORTER_TEST_ENV, env.PROM_REST_EXPORTER_TEST_ENV", "{}"))
+	})
+}
+
+func TestEngineLibraryCompileErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jqlib")
+	defer os.RemoveAll(dir)
+	writeModule(t, dir, "broken", "def ok: 1;\ndef broken: (1;\n")
+	cases := []struct {
+		prelude  string
+		program  string
+		location string
+	}{
+		{"def pct:\n  . * 100;\ndef half: . / ;", ".", "at <library>, line 3"},
+		{"def pct:\n  . * 100;", ".a |\n pct | (", "at <top-level>, line 2"},
+		{`include "broken";`, ".", filepath.Join(dir, "broken.jq") + ", line 2"},
+	}
+
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		for _, c := range cases {
+			_, err := engine.Compile(c.program, nil, &Library{Paths: []string{dir}, Prelude: c.prelude})
+			assert.NotNil(t, err, c.prelude)
+			assert.Contains(t, err.Error(), c.location, c.prelude)
+		}
+	})
+}
+
+func TestReadSpecWithEngine(t *testing.T) {
+	for _, name := range Engines() {
+		spec, err := ReadSpecFromYamlString(`
+engine: ` + name + `
+endpoints:
+  - port: 8080
+    targets:
+      - url: http://localhost:9011/test
+        metrics:
+          - name: user_count
+            selector: .users | length`)
+		assert.Nil(t, err)
+		engine, _ := GetEngine(name)
+		assert.Equal(t, engine, spec.Endpoints[0].Targets[0].Engine)
+	}
+}
+
+func TestReadSpecWithInvalidEngine(t *testing.T) {
+	spec, err := ReadSpecFromYamlString(`
+engine: jsonnet
+endpoints:
+  - port: 8080`)
+	assert.Nil(t, spec)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid engine jsonnet")
+}
+
+func TestSelectorLanguages(t *testing.T) {
+	input := `{"users": [
+		{"id": 1, "name": "George", "score": 1.5, "admin": true},
+		{"id": 2, "name": "Janet", "score": 2, "admin": false, "group": "ops"}]}`
+	cases := []struct {
+		language string
+		program  string
+		expected []string
+	}{
+		{LanguageJSONPath, "{.users[*].name}", []string{"George", "Janet"}},
+		{LanguageJSONPath, ".users[*].score", []string{"1.5", "2"}},
+		{LanguageJSONPath, "$.users[?(@.id==2)].name", []string{"Janet"}},
+		{LanguageJSONPath, "{.users[?(@.admin==false)]}", []string{`{"admin":false,"group":"ops","id":2,"name":"Janet","score":2}`}},
+		{LanguageJSONPath, ".users[1]", []string{`{"admin":false,"group":"ops","id":2,"name":"Janet","score":2}`}},
+		{LanguageJSONPath, ".users[*].group", []string{"ops"}},
+		{LanguageJSONPath, "$.users[?(@.id>=2 && @.score<3)].id", []string{"2"}},
+		{LanguageJSONPath, ".users[0,1].id", []string{"1", "2"}},
+		{LanguageJSONPath, "$['users'][1]['name']", []string{"Janet"}},
+		{LanguageJSONPath, `.users[?(@.name == 'Janet')]["id"]`, []string{"2"}},
+		{LanguageJSONPath, `.users[?(@.name != "it's")].id`, []string{"1", "2"}},
+		{LanguageJSONPath, `.users[?(@.name != 'say "hi" \'')].id`, []string{"1", "2"}},
+		{LanguageCEL, "self.users.map(u, u.name)", []string{"George", "Janet"}},
+		{LanguageCEL, "size(self.users)", []string{"2"}},
+		{LanguageCEL, "self.users.filter(u, u.admin).map(u, u.score)", []string{"1.5"}},
+		{LanguageCEL, `self.users[1].name + "!"`, []string{"Janet!"}},
+		{LanguageCEL, `has(self.users[0].group) ? self.users[0].group : "none"`, []string{"none"}},
+	}
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		for _, c := range cases {
+			sel, err := (&selectorCompiler{engine: engine}).compile(c.language, c.program)
+			assert.Nil(t, err, c.program)
+			doc, _ := engine.Parse([]byte(input))
+			results, err := sel.Run(doc, nil)
+			assert.Nil(t, err, c.program)
+			strs := make([]string, 0, len(results))
+			for _, r := range results {
+				strs = append(strs, r.ToString())
+				r.Free()
+			}
+			doc.Free()
+			assert.Equal(t, c.expected, strs, c.program)
+		}
+	})
+}
+
+func TestSelectorLanguagesMissingKeys(t *testing.T) {
+	input := `{"users": [{"id": 1, "name": "George"}]}`
+	cases := []struct {
+		language string
+		program  string
+		err      string
+	}{
+		{LanguageJSONPath, ".users[0].group", "unknown key group"},
+		{LanguageJSONPath, ".users[5]", "index 5 out of bounds"},
+		{LanguageJSONPath, "$['groups']", "unknown key groups"},
+		{LanguageCEL, "self.users[0].group", "no such key: group"},
+	}
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		doc, _ := engine.Parse([]byte(input))
+		defer doc.Free()
+		for _, c := range cases {
+			sel, err := (&selectorCompiler{engine: engine}).compile(c.language, c.program)
+			assert.Nil(t, err, c.program)
+			results, err := sel.Run(doc, nil)
+			assert.Nil(t, results, c.program)
+			assert.NotNil(t, err, c.program)
+			assert.Contains(t, err.Error(), c.err, c.program)
+		}
+
+		// Wildcards and filters yield no result for missing keys
+		sel, _ := (&selectorCompiler{engine: engine}).compile(LanguageJSONPath, ".users[*].group")
+		results, err := sel.Run(doc, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(results))
+	})
+}
+
+func TestCompileInvalidSelectorLanguages(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		_, err := (&selectorCompiler{engine: engine}).compile(LanguageJSONPath, "{.users[}")
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "JSONPath compile error for selector {.users[}")
+
+		_, err = (&selectorCompiler{engine: engine}).compile(LanguageCEL, "self.users.(")
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "CEL compile error for selector self.users.(")
+	})
+}
+
+func TestSelectorVars(t *testing.T) {
+	input := `{"users": [{"name": "George", "score": 1.5}, {"name": "Janet", "score": 3}]}`
+	cases := []struct {
+		language string
+		program  string
+		expected []string
+	}{
+		{LanguageJq, `.users[] | select(.score > $threshold) | .name`, []string{"Janet"}},
+		{LanguageJq, `$prefix + .users[0].name`, []string{"app_George"}},
+		{LanguageJq, `$labels.env`, []string{"prod"}},
+		{LanguageJq, `.users[] | select(.score > $threshold) | .name # above the threshold`, []string{"Janet"}},
+		{LanguageCEL, `self.users.filter(u, u.score > threshold).map(u, u.name)`, []string{"Janet"}},
+		{LanguageCEL, `prefix + self.users[0].name`, []string{"app_George"}},
+	}
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		c := &selectorCompiler{engine: engine, varNames: []string{"labels", "prefix", "threshold"}}
+		vars, err := fromNative(engine, map[string]interface{}{
+			"labels":    map[string]interface{}{"env": "prod"},
+			"prefix":    "app_",
+			"threshold": 2.0,
+		})
+		assert.Nil(t, err)
+		defer vars.Free()
+		doc, _ := engine.Parse([]byte(input))
+		defer doc.Free()
+		for _, cs := range cases {
+			sel, err := c.compile(cs.language, cs.program)
+			assert.Nil(t, err, cs.program)
+			results, err := sel.Run(doc, vars)
+			assert.Nil(t, err, cs.program)
+			strs := make([]string, 0, len(results))
+			for _, r := range results {
+				strs = append(strs, r.ToString())
+				r.Free()
+			}
+			assert.Equal(t, cs.expected, strs, cs.program)
+		}
+	})
+}
+
+func TestSelectorUndefinedVar(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine Engine) {
+		c := &selectorCompiler{engine: engine, varNames: []string{"threshold"}}
+		_, err := c.compile(LanguageJq, ".score > $limit")
+		assert.NotNil(t, err)
+		_, err = c.compile(LanguageCEL, "self.score > limit")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,140 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"sort"
+)
+
+// resolveTargets applies the target_defaults and the metric_sets referenced by targets and modules.
+// Targets get deep copies, so that they can be compiled independently.
+func resolveTargets(ex *ExporterSpec) error {
+	if ex.TargetDefaults != nil && ex.TargetDefaults.URL != "" {
+		return errors.New("Target defaults must not have 'url'")
+	}
+	for _, e := range ex.Endpoints {
+		for i, t := range e.Targets {
+			resolved, err := resolveTarget(ex, t)
+			if err != nil {
+				return fmt.Errorf("Target %s: %s", t.URL, err)
+			}
+			e.Targets[i] = resolved
+		}
+	}
+	names := make([]string, 0, len(ex.Modules))
+	for name := range ex.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resolved, err := resolveTarget(ex, ex.Modules[name])
+		if err != nil {
+			return fmt.Errorf("Module %s: %s", name, err)
+		}
+		ex.Modules[name] = resolved
+	}
+	return nil
+}
+
+// resolveTarget returns the target with the target_defaults applied to its unset options
+// and the metrics of its metric_sets, or of the metric_sets of the defaults if it has none.
+// Metrics override metrics of the same name from the defaults and metric sets.
+func resolveTarget(ex *ExporterSpec, t *TargetSpec) (*TargetSpec, error) {
+	if ex.TargetDefaults == nil && len(t.MetricSets) == 0 {
+		return t, nil
+	}
+	resolved := &TargetSpec{}
+	if ex.TargetDefaults != nil {
+		err := deepCopy(ex.TargetDefaults, resolved)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defaultMetrics := resolved.Metrics
+	setNames := resolved.MetricSets
+	if len(t.MetricSets) > 0 {
+		setNames = t.MetricSets
+	}
+
+	resolved.URL = t.URL
+	if t.User != "" {
+		resolved.User = t.User
+	}
+	if t.Password != "" {
+		resolved.Password = t.Password
+	}
+	if len(t.Headers) > 0 {
+		if resolved.Headers == nil {
+			resolved.Headers = make(map[string]string)
+		}
+		for k, v := range t.Headers {
+			resolved.Headers[k] = v
+		}
+	}
+	if t.Insecure != nil {
+		resolved.Insecure = t.Insecure
+	}
+	if t.Exec != nil {
+		resolved.Exec = t.Exec
+	}
+	if t.AutoDiscover != nil {
+		resolved.AutoDiscover = t.AutoDiscover
+	}
+	if t.RelabelConfigs != nil {
+		resolved.RelabelConfigs = t.RelabelConfigs
+	}
+	if len(t.Vars) > 0 {
+		if resolved.Vars == nil {
+			resolved.Vars = make(map[string]interface{})
+		}
+		for k, v := range t.Vars {
+			resolved.Vars[k] = v
+		}
+	}
+
+	metrics := defaultMetrics
+	for _, name := range setNames {
+		set, ok := ex.MetricSets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown metric set %s", name)
+		}
+		err := validateMetrics(set)
+		if err != nil {
+			return nil, fmt.Errorf("Metric set %s: %s", name, err)
+		}
+		var copied []*MetricSpec
+		err = deepCopy(set, &copied)
+		if err != nil {
+			return nil, err
+		}
+		metrics = overrideMetrics(metrics, copied)
+	}
+	resolved.Metrics = overrideMetrics(metrics, t.Metrics)
+	resolved.MetricSets = setNames
+	return resolved, nil
+}
+
+// overrideMetrics appends metrics to base and removes the metrics of base with the same names
+func overrideMetrics(base []*MetricSpec, metrics []*MetricSpec) []*MetricSpec {
+	names := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		names[m.Name] = true
+	}
+	result := make([]*MetricSpec, 0, len(base)+len(metrics))
+	for _, m := range base {
+		if !names[m.Name] {
+			result = append(result, m)
+		}
+	}
+	return append(result, metrics...)
+}
+
+// deepCopy copies the configuration options of src to dst. Calculated fields are not copied.
+func deepCopy(src interface{}, dst interface{}) error {
+	data, err := yaml.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, dst)
+}
@@ -0,0 +1,116 @@
+package spec
+
+import (
+	"context"
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+	"strings"
+)
+
+// jsonPathLanguage is JSONPath with the operators of gval in filter expressions
+var jsonPathLanguage = gval.NewLanguage(gval.Full(), jsonpath.Language())
+
+// jsonPathSelector runs a JSONPath expression
+type jsonPathSelector struct {
+	engine Engine
+	path   gval.Evaluable
+	// multi is true if the path can match several values, which are then returned as list
+	multi bool
+}
+
+func compileJSONPath(engine Engine, selector string) (Selector, error) {
+	path := strings.TrimSpace(selector)
+	// Braces around the expression, as in kubectl, are optional
+	if strings.HasPrefix(path, "{") && strings.HasSuffix(path, "}") {
+		path = strings.TrimSpace(path[1 : len(path)-1])
+	}
+	// So is the $ of the root element
+	if strings.HasPrefix(path, ".") || strings.HasPrefix(path, "[") {
+		path = "$" + path
+	}
+	path = doubleQuoteStrings(path)
+	eval, err := jsonPathLanguage.NewEvaluable(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonPathSelector{engine, eval, isMultiPath(path)}, nil
+}
+
+// Run returns every value matched by the path. Missing keys and indexes are errors, like in CEL, unless
+// the path has wildcards or filters, which then yield no result for them. JSONPath has no variables.
+func (s *jsonPathSelector) Run(input Value, vars Value) ([]Value, error) {
+	native, err := toNative(input)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.path(context.Background(), native)
+	if err != nil {
+		return nil, err
+	}
+	if !s.multi {
+		return fromNatives(s.engine, []interface{}{found})
+	}
+	list, _ := found.([]interface{})
+	return fromNatives(s.engine, list)
+}
+
+// doubleQuoteStrings turns the single-quoted strings of path, e.g. in ['key'], into double-quoted ones.
+// gval reads single quotes as Go character literals, which can only hold one character.
+func doubleQuoteStrings(path string) string {
+	var b strings.Builder
+	var quote rune
+	escaped := false
+	for _, c := range path {
+		switch {
+		case escaped:
+			// Double-quoted strings do not escape single quotes
+			if c != '\'' {
+				b.WriteRune('\\')
+			}
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+			continue
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+			c = '"'
+		case quote != 0 && c == quote:
+			quote = 0
+			c = '"'
+		case quote == '\'' && c == '"':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// isMultiPath returns true if the path contains wildcards, recursive descent, filters, slices or unions.
+// The jsonpath package returns the matches of these paths as list.
+func isMultiPath(path string) bool {
+	depth := 0
+	var quote rune
+	prev := rune(0)
+	for _, c := range path {
+		switch {
+		case quote != 0:
+			if c == quote && prev != '\\' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '*' && depth <= 1:
+			return true
+		case c == '.' && prev == '.' && depth == 0:
+			return true
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 1 && (c == '?' || c == ':' || c == ','):
+			return true
+		}
+		prev = c
+	}
+	return false
+}
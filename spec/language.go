@@ -0,0 +1,137 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Selector languages
+const (
+	LanguageJq       = "jq"
+	LanguageJSONPath = "jsonpath"
+	LanguageCEL      = "cel"
+)
+
+// languageNames are the names of the selector languages in error messages
+var languageNames = map[string]string{
+	LanguageJq:       "Jq",
+	LanguageJSONPath: "JSONPath",
+	LanguageCEL:      "CEL",
+}
+
+// isValidLanguage returns true for the selector languages and the empty string, which means jq
+func isValidLanguage(language string) bool {
+	_, ok := languageNames[language]
+	return ok || language == ""
+}
+
+// selectorCompiler compiles the selectors of a target
+type selectorCompiler struct {
+	engine Engine
+	// Names of the variables the selectors can use, without $
+	varNames []string
+	// Functions available to jq selectors, may be nil
+	library *Library
+}
+
+// compile compiles a selector of the given language, jq if empty
+func (c *selectorCompiler) compile(language string, selector string) (Selector, error) {
+	if language == "" {
+		language = LanguageJq
+	}
+	var sel Selector
+	var err error
+	switch language {
+	case LanguageJSONPath:
+		sel, err = compileJSONPath(c.engine, selector)
+	case LanguageCEL:
+		sel, err = compileCEL(c.engine, selector, c.varNames)
+	default:
+		sel, err = c.engine.Compile(selector, c.varNames, c.library)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s compile error for selector %s: %s\n", languageNames[language], selector, err)
+	}
+	return sel, nil
+}
+
+// pipeSelector runs the second selector on each result of the first, like the jq pipe
+type pipeSelector struct {
+	first  Selector
+	second Selector
+}
+
+func (p pipeSelector) Run(input Value, vars Value) ([]Value, error) {
+	firstResults, err := p.first.Run(input, vars)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Value, 0, len(firstResults))
+	for i, r := range firstResults {
+		secondResults, err := p.second.Run(r, vars)
+		if err != nil {
+			freeValues(results)
+			freeValues(firstResults[i:])
+			return nil, err
+		}
+		results = append(results, secondResults...)
+		r.Free()
+	}
+	return results, nil
+}
+
+func freeValues(values []Value) {
+	for _, v := range values {
+		v.Free()
+	}
+}
+
+// nativeValue is implemented by values that wrap the representation of encoding/json
+type nativeValue interface {
+	Native() interface{}
+}
+
+// nativeEngine is implemented by engines whose values wrap the representation of encoding/json
+type nativeEngine interface {
+	FromNative(v interface{}) Value
+}
+
+// toNative converts a value to the representation of encoding/json, which the JSONPath and CEL selectors run on
+func toNative(v Value) (interface{}, error) {
+	if n, ok := v.(nativeValue); ok {
+		return n.Native(), nil
+	}
+	if v.IsString() {
+		// Strings are not quoted by ToString
+		return v.ToString(), nil
+	}
+	var native interface{}
+	err := json.Unmarshal([]byte(v.ToString()), &native)
+	return native, err
+}
+
+// fromNative converts a value in the representation of encoding/json to a value of the engine
+func fromNative(engine Engine, native interface{}) (Value, error) {
+	if n, ok := engine.(nativeEngine); ok {
+		return n.FromNative(native), nil
+	}
+	data, err := json.Marshal(native)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Parse(data)
+}
+
+// fromNatives converts results of JSONPath and CEL selectors to values of the engine
+func fromNatives(engine Engine, natives []interface{}) ([]Value, error) {
+	values := make([]Value, 0, len(natives))
+	for _, n := range natives {
+		v, err := fromNative(engine, n)
+		if err != nil {
+			freeValues(values)
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,87 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Relabel actions
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelHashMod   = "hashmod"
+	RelabelLowercase = "lowercase"
+)
+
+// MetricNameLabel can be used in source_labels to refer to the metric name
+const MetricNameLabel = "__name__"
+
+// RelabelConfig rewrites the labels of the extracted series
+// like a Prometheus metric_relabel_configs entry.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string
+	Regex        string
+	TargetLabel  string `yaml:"target_label"`
+	Replacement  string
+	Modulus      uint64
+	Action       string
+	// Calculated fields:
+	RegexInst *regexp.Regexp `yaml:"-"`
+}
+
+// UnmarshalYAML sets the same defaults as Prometheus for omitted fields
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	type plain RelabelConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *RelabelConfig) Validate() error {
+	switch c.Action {
+	case RelabelReplace, RelabelHashMod, RelabelLowercase:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("Relabel action %s requires 'target_label'", c.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop:
+	default:
+		return fmt.Errorf("Invalid relabel action %s", c.Action)
+	}
+	if c.TargetLabel == MetricNameLabel {
+		return errors.New("Relabeling cannot change the metric name")
+	}
+	if c.Action == RelabelHashMod && c.Modulus == 0 {
+		return errors.New("Relabel action hashmod requires 'modulus' > 0")
+	}
+	return nil
+}
+
+func validateRelabelConfigs(configs []*RelabelConfig) error {
+	for _, c := range configs {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compileRelabelConfigs(configs []*RelabelConfig) error {
+	for _, c := range configs {
+		var err error
+		c.RegexInst, err = regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid relabel regex %s: %s", c.Regex, err)
+		}
+	}
+	return nil
+}
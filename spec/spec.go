@@ -3,14 +3,97 @@ package spec
 import (
 	"errors"
 	"fmt"
-	"github.com/sandro-h/prom_rest_exporter/jq"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ExecURLPrefix = "exec://"
+
+// Metric modes
+const (
+	// ModeAccumulate adds up the extracted values of each scrape into a counter
+	ModeAccumulate = "accumulate"
+	// ModeStateSet emits one series per state with value 1 for the current state and 0 for the others
+	ModeStateSet = "stateset"
+)
+
+// TypeInfo is the type of metrics with constant value 1 whose labels are taken from JSON objects.
+// It is exposed as gauge.
+const TypeInfo = "info"
+
+// Timestamp formats. Any other format is used as Go time layout.
+const (
+	TimestampUnix    = "unix"
+	TimestampUnixMs  = "unix_ms"
+	TimestampRFC3339 = "rfc3339"
+)
+
+// Derive options
+const (
+	// DeriveDelta emits the difference to the previous scrape
+	DeriveDelta = "delta"
+	// DeriveRate emits the difference to the previous scrape per second
+	DeriveRate = "rate"
+)
+
+// Behaviors for labels whose selector yields no value or null
+const (
+	// LabelOmit leaves the label out of the series
+	LabelOmit = "omit"
+	// LabelDropSeries leaves the whole series out
+	LabelDropSeries = "drop_series"
+	// LabelEmpty sets the label to an empty string
+	LabelEmpty = "empty"
+	// LabelDefault sets the label to its default_value
+	LabelDefault = "default"
+)
+
+// NameKeyPlaceholder is replaced with the key of each value in dynamic metric names
+const NameKeyPlaceholder = "{{key}}"
+
+// DefaultMaxFamilies is the default number of metric families a metric with a dynamic name may emit
+const DefaultMaxFamilies = 100
+
+const (
+	DefaultHost        = "localhost"
+	DefaultMetricsPath = "/metrics"
+	ProbePath          = "/probe"
 )
 
 type ExporterSpec struct {
 	Endpoints        []*EndpointSpec
 	CacheTimeSeconds int `yaml:"cache_time"`
+	// Modules are targets without url, used by probe endpoints.
+	Modules          map[string]*TargetSpec
+	WebConfigFile    string `yaml:"web_config_file"`
+	ReadyAfterScrape bool   `yaml:"ready_after_scrape"`
+	StateFile        string `yaml:"state_file"`
+	// Engine runs the selectors, DefaultEngine if empty
+	Engine string
+	// Vars are variables for the selectors of all targets
+	Vars      map[string]interface{}
+	JqLibrary *JqLibrarySpec `yaml:"jq_library"`
+	// MetricSets are lists of metrics that targets reference by name in their metric_sets
+	MetricSets map[string][]*MetricSpec `yaml:"metric_sets"`
+	// TargetDefaults are applied to the options that targets and modules do not set
+	TargetDefaults *TargetSpec `yaml:"target_defaults"`
+	// Calculated fields:
+	WebConfig *WebConfig `yaml:"-"`
+}
+
+// JqLibrarySpec defines jq functions available to all jq selectors
+type JqLibrarySpec struct {
+	// Paths to search for modules, like JQ_LIBRARY_PATH of jq
+	Paths []string
+	// Modules are included in all selectors
+	Modules []string
+	// Definitions are jq function definitions
+	Definitions string
 }
 
 type EndpointSpec struct {
@@ -19,35 +102,117 @@ type EndpointSpec struct {
 	Targets          []*TargetSpec
 	CacheTimeSeconds int  `yaml:"cache_time"`
 	InclMetaMetrics  bool `yaml:"meta_metrics"`
+	Probe            bool
+	Path             string
+	MaxSeries        int              `yaml:"max_series"`
+	MaxLabelLength   int              `yaml:"max_label_length"`
+	RelabelConfigs   []*RelabelConfig `yaml:"metric_relabel_configs"`
+	// Vars are variables for the selectors of the targets of the endpoint
+	Vars map[string]interface{}
+	// Calculated fields:
+	// Modules are the modules of a probe endpoint, compiled with the vars of the endpoint
+	Modules map[string]*TargetSpec `yaml:"-"`
 }
 
 type TargetSpec struct {
-	URL      string
-	User     string
-	Password string
-	Headers  map[string]string
-	Insecure bool
-	Metrics  []*MetricSpec
+	URL            string
+	User           string
+	Password       string
+	Headers        map[string]string
+	Insecure       *bool
+	Exec           *ExecSpec
+	AutoDiscover   *AutoDiscoverSpec `yaml:"auto_discover"`
+	RelabelConfigs []*RelabelConfig  `yaml:"metric_relabel_configs"`
+	Metrics        []*MetricSpec
+	MetricSets     []string `yaml:"metric_sets"`
+	Vars           map[string]interface{}
+	// Calculated fields:
+	Engine Engine `yaml:"-"`
+	// VarValues are the vars of the exporter, endpoint and target merged
+	VarValues map[string]interface{} `yaml:"-"`
+	// Module is the name of the module of a probe target
+	Module string `yaml:"-"`
+}
+
+// AutoDiscoverSpec turns all numeric values of a response into metrics named after their path
+type AutoDiscoverSpec struct {
+	Prefix      string
+	LabelKeys   []string `yaml:"label_keys"`
+	Include     []string
+	Exclude     []string
+	MaxFamilies int `yaml:"max_families"`
+	// Calculated fields:
+	IncludeRegexes []*regexp.Regexp `yaml:"-"`
+	ExcludeRegexes []*regexp.Regexp `yaml:"-"`
+}
+
+type ExecSpec struct {
+	Args           []string
+	Env            map[string]string
+	TimeoutSeconds int `yaml:"timeout"`
 }
 
 type MetricSpec struct {
-	Name        string
-	Description string
-	Type        string
-	Selector    string
-	ValSelector string `yaml:"val_selector"`
-	Labels      []*LabelSpec
+	Name              string
+	Description       string
+	Type              string
+	Selector          string
+	Language          string
+	ValSelector       string `yaml:"val_selector"`
+	NameSelector      string `yaml:"name_selector"`
+	MaxFamilies       int    `yaml:"max_families"`
+	MaxSeries         int    `yaml:"max_series"`
+	Mode              string
+	Derive            string
+	TimestampSelector string             `yaml:"timestamp_selector"`
+	TimestampFormat   string             `yaml:"timestamp_format"`
+	ValueMapping      map[string]float64 `yaml:"value_mapping"`
+	DefaultValue      *float64           `yaml:"default_value"`
+	States            []string
+	InfoKeys          []string         `yaml:"info_keys"`
+	RelabelConfigs    []*RelabelConfig `yaml:"metric_relabel_configs"`
+	Labels            []*LabelSpec
 	// Calculated fields:
-	OnlyFixedLabels bool   `yaml:"-"`
-	JqInst          *jq.Jq `yaml:"-"`
-	ValJqInst       *jq.Jq `yaml:"-"`
+	OnlyFixedLabels bool     `yaml:"-"`
+	JqInst          Selector `yaml:"-"`
+	ValJqInst       Selector `yaml:"-"`
+	NameJqInst      Selector `yaml:"-"`
+	TsJqInst        Selector `yaml:"-"`
 }
 
 type LabelSpec struct {
-	Name       string
-	Selector   string
-	FixedValue string `yaml:"fixed_value"`
-	JqInst     *jq.Jq `yaml:"-"`
+	Name         string
+	Selector     string
+	Language     string
+	FixedValue   string   `yaml:"fixed_value"`
+	OnMissing    string   `yaml:"on_missing"`
+	DefaultValue string   `yaml:"default_value"`
+	JqInst       Selector `yaml:"-"`
+}
+
+// IsExec returns true if the target runs a local command instead of calling a REST endpoint
+func (s *TargetSpec) IsExec() bool {
+	return strings.HasPrefix(s.URL, ExecURLPrefix)
+}
+
+// IsInsecure returns true if the certificate of an https target is not checked
+func (s *TargetSpec) IsInsecure() bool {
+	return s.Insecure != nil && *s.Insecure
+}
+
+// RedactedURL returns the url of the target without user and password
+func (s *TargetSpec) RedactedURL() string {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.User == nil {
+		return s.URL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// ExecCommand returns the command to run for exec:// targets
+func (s *TargetSpec) ExecCommand() string {
+	return strings.TrimPrefix(s.URL, ExecURLPrefix)
 }
 
 func (es TargetSpec) String() string {
@@ -76,6 +241,11 @@ func readSpec(yamlBytes *[]byte) (*ExporterSpec, error) {
 		return nil, err
 	}
 
+	err = resolveTargets(&ex)
+	if err != nil {
+		return nil, err
+	}
+
 	err = validateSpec(&ex)
 	if err != nil {
 		return nil, err
@@ -94,19 +264,50 @@ func validateSpec(ex *ExporterSpec) error {
 }
 
 func postProcessSpec(ex *ExporterSpec) error {
-	var err error
+	engine, err := GetEngine(ex.Engine)
+	if err != nil {
+		return err
+	}
+
+	if ex.WebConfigFile != "" {
+		ex.WebConfig, err = ReadWebConfigFromYamlFile(ex.WebConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	lib, err := compileJqLibrary(ex.JqLibrary, engine)
+	if err != nil {
+		return err
+	}
+
 	for _, e := range ex.Endpoints {
+		err := compileRelabelConfigs(e.RelabelConfigs)
+		if err != nil {
+			return err
+		}
 		for _, t := range e.Targets {
-			for _, m := range t.Metrics {
-				err = compileMetricSelectors(m)
-				if err != nil {
-					return err
-				}
-
-				err = compileMetricLabels(m)
-				if err != nil {
-					return err
-				}
+			t.VarValues = mergeVars(ex.Vars, e.Vars, t.Vars)
+			err := compileTargetMetrics(t, engine, lib)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, mod := range ex.Modules {
+		mod.VarValues = mergeVars(ex.Vars, mod.Vars)
+		err := compileTargetMetrics(mod, engine, lib)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range ex.Endpoints {
+		if e.Probe {
+			e.Modules, err = compileEndpointModules(ex, e, engine, lib)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -114,29 +315,195 @@ func postProcessSpec(ex *ExporterSpec) error {
 	return nil
 }
 
-func compileMetricSelectors(m *MetricSpec) error {
+// compileEndpointModules returns the modules for the probe endpoint e. If it has vars,
+// it gets copies of the modules compiled with them.
+func compileEndpointModules(ex *ExporterSpec, e *EndpointSpec, engine Engine, lib *Library) (map[string]*TargetSpec, error) {
+	if len(e.Vars) == 0 {
+		return ex.Modules, nil
+	}
+	modules := make(map[string]*TargetSpec, len(ex.Modules))
+	for name, mod := range ex.Modules {
+		copied := &TargetSpec{}
+		err := deepCopy(mod, copied)
+		if err != nil {
+			return nil, err
+		}
+		copied.VarValues = mergeVars(ex.Vars, e.Vars, mod.Vars)
+		err = compileTargetMetrics(copied, engine, lib)
+		if err != nil {
+			return nil, fmt.Errorf("Module %s: %s", name, err)
+		}
+		modules[name] = copied
+	}
+	return modules, nil
+}
+
+// compileJqLibrary returns the library for the selectors, or nil if there is none.
+// The library is compiled once on its own to report its errors.
+func compileJqLibrary(s *JqLibrarySpec, engine Engine) (*Library, error) {
+	if s == nil {
+		return nil, nil
+	}
+	lib := &Library{}
+	for _, p := range s.Paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		lib.Paths = append(lib.Paths, abs)
+	}
+	// The includes share the first line with the definitions so that their line numbers stay the same
+	for _, m := range s.Modules {
+		lib.Prelude += fmt.Sprintf("include %q; ", m)
+	}
+	lib.Prelude += s.Definitions
+	_, err := engine.Compile(".", nil, lib)
+	if err != nil {
+		return nil, fmt.Errorf("Jq library compile error: %s", err)
+	}
+	return lib, nil
+}
+
+func compileTargetMetrics(t *TargetSpec, engine Engine, lib *Library) error {
+	t.Engine = engine
+	c := &selectorCompiler{engine, varNames(t.VarValues), lib}
+	err := compileRelabelConfigs(t.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+	if t.AutoDiscover != nil {
+		t.AutoDiscover.IncludeRegexes, err = compilePathPatterns(t.AutoDiscover.Include)
+		if err != nil {
+			return err
+		}
+		t.AutoDiscover.ExcludeRegexes, err = compilePathPatterns(t.AutoDiscover.Exclude)
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range t.Metrics {
+		err = compileMetricSelectors(m, c)
+		if err != nil {
+			return err
+		}
+
+		err = compileMetricLabels(m, c)
+		if err != nil {
+			return err
+		}
+
+		err = compileRelabelConfigs(m.RelabelConfigs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compilePathPatterns compiles auto-discovery path patterns, which must match the whole path
+func compilePathPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid auto_discover path pattern %s: %s", p, err)
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes, nil
+}
+
+func compileMetricSelectors(m *MetricSpec, c *selectorCompiler) error {
 	var err error
-	m.JqInst, err = compileJq(m.Selector)
+	m.JqInst, err = c.compile(m.Language, m.Selector)
 	if err != nil {
 		return err
 	}
+	if isKeyedByObject(m) {
+		m.JqInst, err = pipeCompiled(c, m.JqInst, "to_entries[]")
+		if err != nil {
+			return err
+		}
+	}
 
-	if m.ValSelector != "" && m.ValSelector != "." {
-		m.ValJqInst, err = compileJq(m.ValSelector)
+	valSelector := m.ValSelector
+	if valSelector == "." && isJq(m.Language) {
+		valSelector = ""
+	}
+	if valSelector != "" || isKeyedByObject(m) {
+		m.ValJqInst, err = compileEntryValueSelector(c, m, m.Language, valSelector)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if m.TimestampSelector != "" {
+		m.TsJqInst, err = compileEntryValueSelector(c, m, m.Language, m.TimestampSelector)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.NameSelector != "" {
+		m.NameJqInst, err = c.compile(m.Language, m.NameSelector)
+	} else if isKeyedByObject(m) {
+		m.NameJqInst, err = c.compile(LanguageJq, ".key")
+	}
+	return err
+}
+
+// HasDynamicName returns true if the metric name contains the {{key}} placeholder
+func (s *MetricSpec) HasDynamicName() bool {
+	return strings.Contains(s.Name, NameKeyPlaceholder)
+}
+
+// isKeyedByObject returns true if the metric emits one family per key of the objects selected by its selector.
+// The selector then yields the {key, value} entries of the objects and all other selectors are applied to the values.
+func isKeyedByObject(m *MetricSpec) bool {
+	return m.HasDynamicName() && m.NameSelector == ""
+}
+
+// compileEntryValueSelector compiles a selector which runs on the base values of a metric,
+// or on the values of the entries if the metric is keyed by object.
+func compileEntryValueSelector(c *selectorCompiler, m *MetricSpec, language string, selector string) (Selector, error) {
+	if !isKeyedByObject(m) {
+		return c.compile(language, selector)
+	}
+	entryValue, err := c.compile(LanguageJq, ".value")
+	if err != nil || selector == "" {
+		return entryValue, err
+	}
+	sel, err := c.compile(language, selector)
+	if err != nil {
+		return nil, err
+	}
+	return pipeSelector{entryValue, sel}, nil
 }
 
-func compileMetricLabels(m *MetricSpec) error {
+// pipeCompiled pipes the results of sel into a jq program
+func pipeCompiled(c *selectorCompiler, sel Selector, program string) (Selector, error) {
+	second, err := c.compile(LanguageJq, program)
+	if err != nil {
+		return nil, err
+	}
+	return pipeSelector{sel, second}, nil
+}
+
+func isJq(language string) bool {
+	return language == "" || language == LanguageJq
+}
+
+func compileMetricLabels(m *MetricSpec, c *selectorCompiler) error {
 	var err error
-	m.OnlyFixedLabels = true
+	// The state label of a stateset and the object labels of an info metric vary per series like selector labels
+	m.OnlyFixedLabels = m.Mode != ModeStateSet && m.Type != TypeInfo
 	for _, l := range m.Labels {
 		if l.FixedValue == "" && l.Selector != "" {
-			l.JqInst, err = compileJq(l.Selector)
+			language := l.Language
+			if language == "" {
+				language = m.Language
+			}
+			l.JqInst, err = compileEntryValueSelector(c, m, language, l.Selector)
 			if err != nil {
 				return err
 			}
@@ -146,30 +513,147 @@ func compileMetricLabels(m *MetricSpec) error {
 	return nil
 }
 
-func compileJq(selector string) (*jq.Jq, error) {
-	jqInst := jq.New()
-	err := jqInst.CompileProgram(selector)
+func (s *ExporterSpec) Validate() error {
+	_, err := GetEngine(s.Engine)
 	if err != nil {
-		msg := fmt.Sprintf("Jq compile error for selector %s: %s\n", selector, err.Error())
-		return nil, errors.New(msg)
+		return err
+	}
+	err = validateVars(s.Vars)
+	if err != nil {
+		return err
+	}
+	if s.JqLibrary != nil {
+		err = s.JqLibrary.Validate()
+		if err != nil {
+			return err
+		}
 	}
-	return jqInst, nil
-}
-
-func (s *ExporterSpec) Validate() error {
 	for _, ep := range s.Endpoints {
 		err := ep.Validate()
 		if err != nil {
 			return err
 		}
+		if ep.Probe && len(s.Modules) == 0 {
+			return errors.New("Endpoint with 'probe' requires 'modules'")
+		}
+	}
+	err = validateSharedPorts(s.Endpoints)
+	if err != nil {
+		return err
+	}
+	for name, mod := range s.Modules {
+		err := validateModule(name, mod)
+		if err != nil {
+			return err
+		}
+	}
+	// Metric sets referenced by targets were validated when resolving the targets
+	for name, set := range s.MetricSets {
+		err := validateMetrics(set)
+		if err != nil {
+			return fmt.Errorf("Metric set %s: %s", name, err)
+		}
 	}
 	return nil
 }
 
+func (s *JqLibrarySpec) Validate() error {
+	for _, p := range s.Paths {
+		info, err := os.Stat(p)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("Jq library path %s is not a directory", p)
+		}
+	}
+	for _, m := range s.Modules {
+		if m == "" || strings.ContainsAny(m, "\"\\") {
+			return fmt.Errorf("Invalid jq library module '%s'", m)
+		}
+	}
+	return nil
+}
+
+// Endpoints can share a port if they use the same host and different paths.
+func validateSharedPorts(endpoints []*EndpointSpec) error {
+	hosts := make(map[int]string)
+	paths := make(map[int]map[string]bool)
+	for _, ep := range endpoints {
+		host, ok := hosts[ep.Port]
+		if !ok {
+			hosts[ep.Port] = ep.ListenHost()
+			paths[ep.Port] = make(map[string]bool)
+		} else if host != ep.ListenHost() {
+			return fmt.Errorf("Endpoints on port %d must use the same host, got %s and %s", ep.Port, host, ep.ListenHost())
+		}
+
+		epPaths := []string{ep.MetricsPath()}
+		if ep.Probe {
+			epPaths = append(epPaths, ProbePath)
+		}
+		for _, p := range epPaths {
+			if paths[ep.Port][p] {
+				return fmt.Errorf("Multiple endpoints on port %d use path %s", ep.Port, p)
+			}
+			paths[ep.Port][p] = true
+		}
+	}
+	return nil
+}
+
+func validateModule(name string, mod *TargetSpec) error {
+	if mod.URL != "" {
+		return fmt.Errorf("Module %s must not have 'url', it is passed as probe target", name)
+	}
+	if mod.Exec != nil {
+		return fmt.Errorf("Module %s must not have 'exec' options", name)
+	}
+	err := validateVars(mod.Vars)
+	if err != nil {
+		return fmt.Errorf("Module %s: %s", name, err)
+	}
+	err = validateRelabelConfigs(mod.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+	return validateMetrics(mod.Metrics)
+}
+
+// ListenHost returns the host to listen on for the endpoint
+func (s *EndpointSpec) ListenHost() string {
+	if s.Host != "" {
+		return s.Host
+	}
+	return DefaultHost
+}
+
+// MetricsPath returns the path on which the endpoint serves its metrics
+func (s *EndpointSpec) MetricsPath() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return DefaultMetricsPath
+}
+
 func (s *EndpointSpec) Validate() error {
 	if s.Port <= 0 {
 		return errors.New("Endpoint 'port' must be > 0")
 	}
+	if s.Path != "" && !strings.HasPrefix(s.Path, "/") {
+		return errors.New("Endpoint 'path' must start with /")
+	}
+	if strings.HasPrefix(s.Path, "/-/") {
+		return errors.New("Endpoint 'path' must not start with /-/, it is reserved for internal endpoints")
+	}
+	if s.MaxSeries < 0 || s.MaxLabelLength < 0 {
+		return errors.New("Endpoint 'max_series' and 'max_label_length' must be >= 0")
+	}
+	err := validateRelabelConfigs(s.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+	err = validateVars(s.Vars)
+	if err != nil {
+		return err
+	}
 
 	for _, t := range s.Targets {
 		err := t.Validate()
@@ -184,7 +668,32 @@ func (s *TargetSpec) Validate() error {
 	if s.URL == "" {
 		return errors.New("Target must have 'url'")
 	}
-	for _, m := range s.Metrics {
+	if s.IsExec() {
+		if s.ExecCommand() == "" {
+			return errors.New("Target with exec:// url must have a command")
+		}
+	} else if s.Exec != nil {
+		return errors.New("Target 'exec' options require an exec:// url")
+	}
+	if s.Exec != nil && s.Exec.TimeoutSeconds < 0 {
+		return errors.New("Target exec 'timeout' must be >= 0")
+	}
+	if s.AutoDiscover != nil && s.AutoDiscover.MaxFamilies < 0 {
+		return errors.New("Target auto_discover 'max_families' must be >= 0")
+	}
+	err := validateVars(s.Vars)
+	if err != nil {
+		return fmt.Errorf("Target %s: %s", s.URL, err)
+	}
+	err = validateRelabelConfigs(s.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+	return validateMetrics(s.Metrics)
+}
+
+func validateMetrics(metrics []*MetricSpec) error {
+	for _, m := range metrics {
 		err := m.Validate()
 		if err != nil {
 			return err
@@ -200,13 +709,55 @@ func (s *MetricSpec) Validate() error {
 	if s.Selector == "" {
 		return errors.New("Metric must have 'selector'")
 	}
+	if !isValidLanguage(s.Language) {
+		return fmt.Errorf("Metric %s has invalid 'language' %s", s.Name, s.Language)
+	}
+	if s.Mode != "" && s.Mode != ModeAccumulate && s.Mode != ModeStateSet {
+		return fmt.Errorf("Metric %s has invalid 'mode' %s", s.Name, s.Mode)
+	}
+	if s.Derive != "" && s.Derive != DeriveDelta && s.Derive != DeriveRate {
+		return fmt.Errorf("Metric %s has invalid 'derive' %s", s.Name, s.Derive)
+	}
+	if s.TimestampFormat != "" && s.TimestampSelector == "" {
+		return fmt.Errorf("Metric %s has 'timestamp_format' but no 'timestamp_selector'", s.Name)
+	}
+	if s.Derive != "" && s.Mode == ModeAccumulate {
+		return fmt.Errorf("Metric %s cannot use 'derive' with mode accumulate", s.Name)
+	}
+	if s.Mode == ModeStateSet && len(s.States) == 0 {
+		return fmt.Errorf("Metric %s with mode stateset must have 'states'", s.Name)
+	}
+	if s.Mode != ModeStateSet && len(s.States) > 0 {
+		return fmt.Errorf("Metric %s has 'states' but mode is not stateset", s.Name)
+	}
+	if s.Mode == ModeStateSet && strings.Contains(s.Name, ":") {
+		return fmt.Errorf("Metric %s with mode stateset must not have ':' in its name, which is also its state label", s.Name)
+	}
+	if s.Mode == ModeStateSet && s.Derive != "" {
+		return fmt.Errorf("Metric %s cannot use 'derive' with mode stateset", s.Name)
+	}
+	if s.Type == TypeInfo && (s.ValSelector != "" || s.Mode != "" || s.Derive != "") {
+		return fmt.Errorf("Metric %s of type info cannot have 'val_selector', 'mode' or 'derive'", s.Name)
+	}
+	if s.MaxSeries < 0 {
+		return fmt.Errorf("Metric %s 'max_series' must be >= 0", s.Name)
+	}
+	if s.NameSelector != "" && !s.HasDynamicName() {
+		return fmt.Errorf("Metric %s has 'name_selector' but no %s in its name", s.Name, NameKeyPlaceholder)
+	}
+	if s.MaxFamilies != 0 && !s.HasDynamicName() {
+		return fmt.Errorf("Metric %s has 'max_families' but no %s in its name", s.Name, NameKeyPlaceholder)
+	}
+	if s.Type != TypeInfo && len(s.InfoKeys) > 0 {
+		return fmt.Errorf("Metric %s has 'info_keys' but type is not info", s.Name)
+	}
 	for _, l := range s.Labels {
 		err := l.Validate()
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return validateRelabelConfigs(s.RelabelConfigs)
 }
 
 func (s *LabelSpec) Validate() error {
@@ -216,5 +767,15 @@ func (s *LabelSpec) Validate() error {
 	if s.Selector == "" && s.FixedValue == "" {
 		return errors.New("Label must have 'selector' or 'fixed_value'")
 	}
+	if !isValidLanguage(s.Language) {
+		return fmt.Errorf("Label %s has invalid 'language' %s", s.Name, s.Language)
+	}
+	if s.OnMissing != "" && s.OnMissing != LabelOmit && s.OnMissing != LabelDropSeries &&
+		s.OnMissing != LabelEmpty && s.OnMissing != LabelDefault {
+		return fmt.Errorf("Label %s has invalid 'on_missing' %s", s.Name, s.OnMissing)
+	}
+	if (s.OnMissing == LabelDefault) != (s.DefaultValue != "") {
+		return fmt.Errorf("Label %s must have 'default_value' if and only if 'on_missing' is default", s.Name)
+	}
 	return nil
 }
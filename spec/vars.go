@@ -0,0 +1,96 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Built-in variables available to all selectors
+const (
+	// VarTargetURL is the url of the scraped target
+	VarTargetURL = "target_url"
+	// VarNow is the unix time of the scrape in seconds
+	VarNow = "now"
+)
+
+// Variables that cannot be set in vars. $ENV and $__loc__ are defined by jq, self holds the input of CEL selectors.
+var reservedVars = map[string]bool{VarTargetURL: true, VarNow: true, "ENV": true, "__loc__": true, CELInputVariable: true}
+
+var varNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateVars(vars map[string]interface{}) error {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !varNamePattern.MatchString(name) {
+			return fmt.Errorf("Invalid variable name %s", name)
+		}
+		if reservedVars[name] {
+			return fmt.Errorf("Variable %s is reserved", name)
+		}
+	}
+	return nil
+}
+
+// mergeVars merges the vars of the levels of the configuration. Later levels override earlier ones.
+func mergeVars(levels ...map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, vars := range levels {
+		for name, val := range vars {
+			merged[name] = toJSONValue(val)
+		}
+	}
+	return merged
+}
+
+// toJSONValue converts a value read from yaml to the representation of encoding/json
+func toJSONValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, elem := range v {
+			arr[i] = toJSONValue(elem)
+		}
+		return arr
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			obj[fmt.Sprint(k)] = toJSONValue(elem)
+		}
+		return obj
+	}
+	return val
+}
+
+// varNames returns the sorted names of the variables available to selectors with the given vars
+func varNames(vars map[string]interface{}) []string {
+	names := []string{VarNow, VarTargetURL}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewVars returns the values of the variables for a scrape of the target at the given time.
+// The returned value must be freed.
+func (s *TargetSpec) NewVars(now time.Time) (Value, error) {
+	vals := make(map[string]interface{}, len(s.VarValues)+2)
+	for name, val := range s.VarValues {
+		vals[name] = val
+	}
+	vals[VarTargetURL] = s.RedactedURL()
+	vals[VarNow] = float64(now.UnixNano()) / float64(time.Second)
+	return fromNative(s.Engine, vals)
+}
@@ -0,0 +1,143 @@
+package spec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// WebConfig secures the endpoints of the exporter itself.
+// It follows the web config file format of the Prometheus exporter-toolkit.
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+	MaxVersion     string `yaml:"max_version"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// ReadWebConfigFromYamlFile reads a web config file. Relative file paths in it
+// are resolved against the directory of the web config file.
+func ReadWebConfigFromYamlFile(path string) (*WebConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c WebConfig
+	err = yaml.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLSServerConfig != nil {
+		dir := filepath.Dir(path)
+		c.TLSServerConfig.CertFile = resolvePath(dir, c.TLSServerConfig.CertFile)
+		c.TLSServerConfig.KeyFile = resolvePath(dir, c.TLSServerConfig.KeyFile)
+		c.TLSServerConfig.ClientCAFile = resolvePath(dir, c.TLSServerConfig.ClientCAFile)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid web config %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+func resolvePath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func (c *WebConfig) Validate() error {
+	for user, hash := range c.BasicAuthUsers {
+		if hash == "" {
+			return fmt.Errorf("Basic auth user %s must have a password hash", user)
+		}
+	}
+	if c.TLSServerConfig != nil {
+		_, err := c.TLSServerConfig.TLSConfig()
+		return err
+	}
+	return nil
+}
+
+// TLSConfig creates the tls configuration for the exporter's http servers
+func (c *TLSServerConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("TLS server config must have 'cert_file' and 'key_file'")
+	}
+	_, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	authType, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("Invalid client_auth_type %s", c.ClientAuthType)
+	}
+	cfg.ClientAuth = authType
+
+	// Like exporter-toolkit, as client certificates would silently not be checked
+	if c.ClientCAFile != "" && authType == tls.NoClientCert {
+		return nil, errors.New("'client_ca_file' requires a 'client_auth_type' other than NoClientCert")
+	}
+	if c.ClientCAFile != "" {
+		caData, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("No certificates found in client_ca_file %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+	} else if authType == tls.VerifyClientCertIfGiven || authType == tls.RequireAndVerifyClientCert {
+		return nil, errors.New("Client certificate verification requires 'client_ca_file'")
+	}
+
+	if c.MinVersion != "" {
+		cfg.MinVersion, ok = tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid min_version %s", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		cfg.MaxVersion, ok = tlsVersions[c.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid max_version %s", c.MaxVersion)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,17 @@
+// Package version holds build information of prom_rest_exporter.
+// Version and Revision are set at build time, e.g.:
+//
+//	go build --ldflags "-X github.com/sandro-h/prom_rest_exporter/version.Version=1.2.0 -X github.com/sandro-h/prom_rest_exporter/version.Revision=$(git rev-parse HEAD)"
+package version
+
+import (
+	"runtime"
+)
+
+var (
+	Version  = "unknown"
+	Revision = "unknown"
+)
+
+// GoVersion is the version of Go used to build prom_rest_exporter
+var GoVersion = runtime.Version()